@@ -15,46 +15,323 @@
 package awsutil
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/jacobsa/fuse"
 	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/resilient"
 	"github.com/pkg/errors"
 )
 
+// MaxRedirects bounds how many redirects a request for an object will
+// follow. Zero stops at the first redirect, which is then reported as an error.
+var MaxRedirects = 10
+
+// Client fetches objects by signed urls, which can stop working before
+// their expiration date says, or expire partway through a long transfer.
+// The zero value uses DefaultClient's http.Client and doesn't renew urls.
+type Client struct {
+	// HTTP makes the requests, nil for that of DefaultClient. Setting its
+	// Timeout bounds each request, body included.
+	HTTP *http.Client
+	// Renew, when set, is asked for a fresh url for the file name of
+	// accession acc once a request with its url is refused with a 403,
+	// and the request is made once more with the new one.
+	Renew func(acc, name string) (string, error)
+	// UserAgent is sent with every request, UserAgent when empty.
+	UserAgent string
+	// MinBackoff and MaxBackoff bound the waits between retries, zero for
+	// the shared policy's first wait and the package's MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Session, when set, gives the session for requests to s3 in a region,
+	// such as one set up for MFA or another endpoint, instead of one using
+	// the default credentials.
+	Session func(region string) *session.Session
+	// S3, when set, makes the s3 client out of a session, s3.New otherwise.
+	S3 func(sess *session.Session, cfgs ...*aws.Config) S3API
+}
+
+// UserAgent identifies fusera to object stores, set by each command to
+// include its version.
+var UserAgent = "fusera"
+
+// DefaultClient is used by the package level functions. Its requests
+// retry under the same policy as requests to the Name Resolver API.
+var DefaultClient = NewClient()
+
+// NewClient returns a Client sending requests over NewTransport, through
+// the shared resilient policy and following redirects up to MaxRedirects.
+func NewClient() *Client {
+	return &Client{HTTP: &http.Client{
+		Transport:     resilient.Default.Transport(NewTransport()),
+		CheckRedirect: checkRedirect,
+	}}
+}
+
+// NewTransport returns a transport tuned for many concurrent requests to
+// the same few object stores, up to MaxConnsPerHost to each, verifying
+// them as SetTLSConfig says.
+func NewTransport() *http.Transport {
+	var cfg *tls.Config
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   15 * time.Second,
+			KeepAlive: 15 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          1000,
+		MaxIdleConnsPerHost:   1000,
+		MaxConnsPerHost:       MaxConnsPerHost,
+		IdleConnTimeout:       20 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+		TLSClientConfig:       cfg,
+	}
+}
+
+// MaxRetries is how many more times a request for an object is made after
+// a 500, 502, 503, 504 or 429 response, or a network error such as a
+// timeout, waiting exponentially longer in between up to MaxBackoff.
+// Any other error status is returned straight away.
+var MaxRetries = 3
+
+// MaxBackoff caps the wait between retries of a request for an object.
+var MaxBackoff = 30 * time.Second
+
+func (c *Client) httpClient() *http.Client {
+	if c == nil || c.HTTP == nil {
+		return DefaultClient.HTTP
+	}
+	return c.HTTP
+}
+
+// do sends req under the shared policy with the package's own retries.
+// A retry is the same request again, so a Range header stays with it.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	ua := UserAgent
+	if c != nil && c.UserAgent != "" {
+		ua = c.UserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	p := resilient.Default.Policy()
+	p.Retries = MaxRetries
+	p.MaxBackoff = MaxBackoff
+	if c != nil && c.MinBackoff > 0 {
+		p.MinBackoff = c.MinBackoff
+	}
+	if c != nil && c.MaxBackoff > 0 {
+		p.MaxBackoff = c.MaxBackoff
+	}
+	return c.httpClient().Do(req.WithContext(resilient.WithPolicy(req.Context(), p)))
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if MaxRedirects <= 0 {
+		twig.Debugf("not following redirect to %s", req.URL.Host)
+		return http.ErrUseLastResponse
+	}
+	if len(via) > MaxRedirects {
+		return errors.Errorf("stopped after %d redirects", MaxRedirects)
+	}
+	// A ranged read that loses its Range on the way would quietly
+	// come back as the whole object, so carry it over explicitly.
+	if r := via[0].Header.Get("Range"); r != "" && req.Header.Get("Range") == "" {
+		req.Header.Set("Range", r)
+	}
+	twig.Debugf("following redirect to %s", req.URL.Host)
+	return nil
+}
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectURL is where a redirect that reached the caller points, which
+// the http client doesn't follow itself when it has no Location, as with
+// s3's PermanentRedirect for a bucket asked for in the wrong region. Then
+// the right endpoint is in the body, and the object is the same under it,
+// though only for an unsigned url: a signed one was signed for its host,
+// and no longer matches its signature anywhere else. The error says why
+// the redirect can't be followed.
+func redirectURL(from *url.URL, resp *http.Response) (*url.URL, error) {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		u, err := from.Parse(loc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%d redirect from %s has a bad Location", resp.StatusCode, from.Host)
+		}
+		return u, nil
+	}
+	var body struct {
+		Code     string
+		Endpoint string
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body); err != nil || body.Endpoint == "" {
+		return nil, errors.Errorf("%d redirect from %s gave no Location or Endpoint to follow", resp.StatusCode, from.Host)
+	}
+	if isSigned(from) {
+		return nil, errors.Errorf("%s from %s to the endpoint %s, a signed url can't be moved to another host", body.Code, from.Host, body.Endpoint)
+	}
+	twig.Debugf("%s from %s, the endpoint is %s", body.Code, from.Host, body.Endpoint)
+	u := *from
+	u.Host = body.Endpoint
+	// the endpoint names the bucket, so a path style url drops it
+	bucket := strings.SplitN(body.Endpoint, ".", 2)[0]
+	if !strings.HasPrefix(from.Host, bucket+".") && strings.HasPrefix(from.Path, "/"+bucket+"/") {
+		u.Path = strings.TrimPrefix(from.Path, "/"+bucket)
+		u.RawPath = ""
+	}
+	return &u, nil
+}
+
+// isSigned reports whether u carries a signature in its query, of any of
+// s3's signing versions or a google signed url.
+func isSigned(u *url.URL) bool {
+	q := u.Query()
+	for _, k := range []string{"X-Amz-Signature", "Signature", "X-Goog-Signature"} {
+		if q.Get(k) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// unfollowedRedirect is the error for a redirect that reached the caller
+// when no more of them are to be followed.
+func unfollowedRedirect(code int, from *url.URL) error {
+	if MaxRedirects <= 0 {
+		return errors.Errorf("%d redirect from %s, and following redirects is turned off", code, from.Host)
+	}
+	return errors.Errorf("%d redirect from %s, stopped after %d redirects", code, from.Host, MaxRedirects)
+}
+
+// HeadObject makes a HEAD request with DefaultClient.
+func HeadObject(url string) (*http.Response, error) {
+	return DefaultClient.HeadObject(url)
+}
+
+// GetObject makes a GET request with DefaultClient.
+func GetObject(url string) (*http.Response, error) {
+	return DefaultClient.GetObject(url)
+}
+
+// GetObjectRange makes a ranged GET request with DefaultClient.
+func GetObjectRange(url, byteRange string) (*http.Response, error) {
+	return DefaultClient.GetObjectRange(url, byteRange)
+}
+
 // Makes an http HEAD request using the URL provided.
 // URL should either point to a public obejct or be
 // a signed URL giving the user GET permissions.
-func HeadObject(url string) (*http.Response, error) {
+// A status other than 2xx is mapped to an error the same way as for
+// GetObjectRange, and the response is only returned on success.
+// The caller must close the response's Body.
+func (c *Client) HeadObject(url string) (*http.Response, error) {
+	return c.HeadObjectContext(context.Background(), url)
+}
+
+// HeadObjectContext is HeadObject bounded by ctx.
+func (c *Client) HeadObjectContext(ctx context.Context, url string) (*http.Response, error) {
 	req, err := http.NewRequest("HEAD", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
+	if isRedirect(resp.StatusCode) {
+		resp.Body.Close()
+		if MaxRedirects <= 0 {
+			return nil, unfollowedRedirect(resp.StatusCode, req.URL)
+		}
+		// the client follows any Location itself, and a HEAD has no
+		// body to hold an Endpoint
+		return nil, errors.Errorf("%d redirect from %s gave no Location to follow", resp.StatusCode, req.URL.Host)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		twig.Debugf("status code: %d\n", resp.StatusCode)
+		resp.Body.Close()
+		return nil, parseHTTPError(resp.StatusCode)
+	}
 	return resp, nil
 }
 
+// ObjectInfo is what a HEAD request says about an object.
+type ObjectInfo struct {
+	// Size is -1 when the server gave no Content-Length.
+	Size int64
+	// ModTime is zero when the server gave no Last-Modified it could
+	// be parsed from.
+	ModTime time.Time
+	// AcceptsRanges is whether the server advertised Accept-Ranges: bytes.
+	AcceptsRanges bool
+}
+
+// HeadObjectInfo makes a HEAD request with DefaultClient, see
+// Client.HeadObjectInfo.
+func HeadObjectInfo(url string) (ObjectInfo, error) {
+	return DefaultClient.HeadObjectInfo(context.Background(), url)
+}
+
+// HeadObjectInfo makes the request of HeadObject and parses the headers
+// describing the object, closing the response itself.
+func (c *Client) HeadObjectInfo(ctx context.Context, url string) (ObjectInfo, error) {
+	resp, err := c.HeadObjectContext(ctx, url)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	info := ObjectInfo{
+		Size:          resp.ContentLength,
+		AcceptsRanges: strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes"),
+	}
+	if v := resp.Header.Get("Last-Modified"); v != "" {
+		if t, err := http.ParseTime(v); err == nil {
+			info.ModTime = t
+		} else {
+			twig.Debugf("couldn't parse Last-Modified of %s: %s", v, err)
+		}
+	}
+	return info, nil
+}
+
 // Makes an http GET request using the URL provided.
 // URL should either point to a public obejct or be
 // a signed URL giving the user GET permissions.
 // url: full url path to the object on AWS
-func GetObject(url string) (*http.Response, error) {
-	resp, err := GetObjectRange(url, "")
+func (c *Client) GetObject(url string) (*http.Response, error) {
+	resp, err := c.GetObjectRange(url, "")
 	if err != nil {
 		return nil, err
 	}
@@ -69,20 +346,77 @@ func GetObject(url string) (*http.Response, error) {
 // Should resemble the format for an http header Range.
 // Example: "bytes="0-1000"
 // Example: "bytes="1000-"
-func GetObjectRange(url, byteRange string) (*http.Response, error) {
+// The caller must close the response's Body, ReadObjectRange and
+// StreamObjectRange take care of that when all of it is wanted anyway.
+func (c *Client) GetObjectRange(url, byteRange string) (*http.Response, error) {
+	return c.GetObjectRangeContext(context.Background(), url, byteRange)
+}
+
+// GetObjectRangeContext is GetObjectRange bounded by ctx, which covers
+// reading the body as well.
+func (c *Client) GetObjectRangeContext(ctx context.Context, url, byteRange string) (*http.Response, error) {
+	return c.getObject(ctx, url, byteRange, time.Time{})
+}
+
+// ErrNotModified is the error from GetObjectIfModified for an object that
+// hasn't changed, which isn't a failure so much as nothing to fetch.
+var ErrNotModified = errors.New("object not modified")
+
+// GetObjectIfModified makes a GET request with DefaultClient, see
+// Client.GetObjectIfModified.
+func GetObjectIfModified(ctx context.Context, url string, since time.Time) (*http.Response, error) {
+	return DefaultClient.GetObjectIfModified(ctx, url, since)
+}
+
+// GetObjectIfModified is GetObject for an object already fetched once,
+// such as with since the ModifiedDate of its nr.File. The object is only
+// sent again when it changed after since, and otherwise the server's 304
+// comes back as ErrNotModified with no response. A zero since always
+// fetches it.
+func (c *Client) GetObjectIfModified(ctx context.Context, url string, since time.Time) (*http.Response, error) {
+	return c.getObject(ctx, url, "", since)
+}
+
+func (c *Client) getObject(ctx context.Context, url, byteRange string, since time.Time) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	if byteRange != "" {
 		req.Header.Add("Range", byteRange)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+	resp, err := c.do(req)
+	for hops := 0; err == nil && isRedirect(resp.StatusCode); hops++ {
+		// without this, the redirect would end up as parseHTTPError's EOF
+		if hops >= MaxRedirects {
+			resp.Body.Close()
+			return nil, unfollowedRedirect(resp.StatusCode, req.URL)
+		}
+		next, rerr := redirectURL(req.URL, resp)
+		resp.Body.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+		twig.Debugf("%s redirected to %s", req.URL.Host, next.Host)
+		// the headers, Range among them, go along as they are
+		req = req.WithContext(ctx)
+		req.URL, req.Host = next, ""
+		resp, err = c.do(req)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusNotModified && !since.IsZero() {
+		resp.Body.Close()
+		return nil, ErrNotModified
+	}
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
 		twig.Debugf("status code: %d\n", resp.StatusCode)
+		resp.Body.Close()
 		return nil, parseHTTPError(resp.StatusCode)
 	}
 	return resp, nil
@@ -92,97 +426,301 @@ func GetObjectRange(url, byteRange string) (*http.Response, error) {
 // Uses the aws-sdk to read the file, assuming that
 // this file will not be publicly accessible and will
 // need to utilize aws credentials on the machine.
+// A Google Cloud Storage url, gs:// or on storage.googleapis.com,
+// is read with google credentials instead, and a local path,
+// bare or as a file:// url, is simply read from disk.
+// A path of - reads the file from stdin, up to MaxNgcSize bytes.
 func ReadNgcFile(path string) ([]byte, error) {
-	// Users should be using virtual-hosted style:
-	// http://[bucket].s3.amazonaws.com/[file]
-	if !strings.Contains(path, "s3.amazonaws.com") {
-		return nil, errors.Errorf("url did not point to a valid amazon s3 location or follow the virtual-hosted style of https://[bucket].[region].s3.amazonzws.com/[file]: %s", path)
+	return ReadNgcFileWith(path, nil)
+}
+
+// Like ReadNgcFile, but tries each of the credential sources in order
+// until one of them can read the file. No sources means the default chain.
+// The sources are aws credentials, so they aren't used for google urls.
+func ReadNgcFileWith(path string, sources []CredentialSource) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case path == "-":
+		data, err = readNgcStdin(os.Stdin)
+	case IsGcsURL(path):
+		data, err = readGcsNgcFile(path)
+	case isLocalPath(path):
+		data, err = ioutil.ReadFile(strings.TrimPrefix(path, "file://"))
+	default:
+		data, err = DefaultClient.readS3NgcFile(path, sources)
 	}
-	u, err := url.Parse(path)
 	if err != nil {
 		return nil, err
 	}
-	sections := strings.Split(u.Hostname(), ".")
-	if len(sections) < 5 {
-		return nil, errors.Errorf("url did not point to a valid amazon s3 location or follow the virtual-hosted style of https://[bucket].[region].s3.amazonzws.com/[file]: %s", path)
+	if len(bytes.TrimSpace(data)) == 0 {
+		if path == "-" {
+			return nil, errors.New("no ngc file was given on stdin")
+		}
+		return nil, errors.Errorf("ngc file at %s is empty, it may not have finished uploading or downloading", path)
 	}
-	bucket := sections[0]
-	twig.Debugf("bucket: %s", bucket)
-	region := sections[1]
-	twig.Debugf("region: %s", region)
-	file := u.Path
-	twig.Debugf("file: %s", file)
+	return data, nil
+}
+
+// MaxNgcSize bounds how much is read as an ngc file from stdin. Real ones
+// are a few kilobytes, so anything near it was piped in by mistake.
+const MaxNgcSize = 1 << 20
+
+func readNgcStdin(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxNgcSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read ngc file from stdin")
+	}
+	if len(data) > MaxNgcSize {
+		return nil, errors.Errorf("more than %d bytes on stdin, that's not an ngc file", MaxNgcSize)
+	}
+	return data, nil
+}
+
+// isLocalPath reports whether path has no scheme, or is a file:// url.
+func isLocalPath(path string) bool {
+	if strings.HasPrefix(path, "file://") {
+		return true
+	}
+	u, err := url.Parse(path)
+	// a single letter scheme is a windows drive
+	return err != nil || len(u.Scheme) <= 1
+}
+
+// newSession is what every request to s3 goes through, for region.
+func newSession(region string) *session.Session {
 	cfg := (&aws.Config{
 		Region: &region,
-	}).WithHTTPClient(&http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   15 * time.Second,
-				KeepAlive: 15 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          1000,
-			MaxIdleConnsPerHost:   1000,
-			IdleConnTimeout:       20 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 10 * time.Second,
-		},
-	})
+	}).WithHTTPClient(&http.Client{Transport: NewTransport()})
 	sess := session.New(cfg)
-	svc := s3.New(sess)
+	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(UserAgent))
+	return sess
+}
+
+// NgcRegion, when set, is the region of the bucket an ngc file is read
+// from, whatever its url says.
+var NgcRegion string
+
+// s3URLError is the error for a url that isn't of an s3 object.
+func s3URLError(path string) error {
+	return errors.Errorf("url did not point to a valid amazon s3 location, expected the virtual-hosted style of https://[bucket].s3.[region].amazonaws.com/[file] or the path style of https://s3.[region].amazonaws.com/[bucket]/[file]: %s", path)
+}
+
+// regionName is what the name of an aws region looks like, such as
+// us-east-1 or us-gov-west-1.
+var regionName = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-[0-9]+$`)
+
+// parseS3URL finds the bucket, key and region of an object on s3 from its
+// url, in either the virtual-hosted or the path style, and with the region
+// as s3.[region], s3-[region] or, as fusera has always taken, in the
+// section before s3 when that looks like a region. The region is empty
+// when the url doesn't say, as for plain s3.amazonaws.com. Hosts in other
+// partitions, like amazonaws.com.cn, work the same way. A bucket can hold
+// dots and labels starting with s3- itself, so the host is read from the
+// right.
+func parseS3URL(path string) (bucket, key, region string, err error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	host := strings.ToLower(u.Hostname())
+	suffix := ""
+	for _, s := range []string{".amazonaws.com", ".amazonaws.com.cn"} {
+		if strings.HasSuffix(host, s) {
+			suffix = s
+		}
+	}
+	if suffix == "" {
+		return "", "", "", s3URLError(path)
+	}
+	sections := strings.Split(strings.TrimSuffix(host, suffix), ".")
+	// the last section naming s3, everything before it is the bucket
+	at := -1
+	for i := len(sections) - 1; i >= 0; i-- {
+		if s := sections[i]; s == "s3" || strings.HasPrefix(s, "s3-") {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		return "", "", "", s3URLError(path)
+	}
+	rest := sections[at+1:]
+	switch {
+	case strings.HasPrefix(sections[at], "s3-"):
+		region = strings.TrimPrefix(sections[at], "s3-")
+	case len(rest) > 0 && rest[0] == "dualstack":
+		if len(rest) > 1 {
+			region = rest[1]
+		}
+	case len(rest) > 0:
+		region = rest[0]
+	}
+	if region == "external-1" {
+		region = "us-east-1"
+	}
+	key = strings.TrimPrefix(u.Path, "/")
+	switch {
+	case at == 0:
+		// path style
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", "", s3URLError(path)
+		}
+		bucket, key = parts[0], parts[1]
+	case at >= 2 && region == "" && regionName.MatchString(sections[at-1]):
+		// [bucket].[region].s3.amazonaws.com
+		bucket, region = strings.Join(sections[:at-1], "."), sections[at-1]
+	default:
+		bucket = strings.Join(sections[:at], ".")
+	}
+	if key == "" {
+		return "", "", "", s3URLError(path)
+	}
+	return bucket, key, region, nil
+}
+
+func (c *Client) readS3NgcFile(path string, sources []CredentialSource) ([]byte, error) {
+	bucket, file, region, err := parseS3URL(path)
+	if err != nil {
+		return nil, err
+	}
+	twig.Debugf("bucket: %s", bucket)
+	twig.Debugf("file: %s", file)
+	switch {
+	case NgcRegion != "":
+		region = NgcRegion
+	case region == "":
+		if region, err = c.bucketRegion(bucket); err != nil {
+			twig.Debugf("%s, trying us-east-1", err)
+			region = "us-east-1"
+		}
+	}
+	twig.Debugf("region: %s", region)
+	sess := c.session(region)
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(file),
 	}
+	if len(sources) == 0 {
+		return getNgcObject(c.s3(sess), input)
+	}
+	var msgs []string
+	for _, src := range sources {
+		svc := c.s3(sess)
+		if creds := src.credentials(sess); creds != nil {
+			svc = c.s3(sess, &aws.Config{Credentials: creds})
+		}
+		bytes, err := getNgcObject(svc, input)
+		if err != nil {
+			twig.Debugf("credential source %s couldn't read ngc file: %s", src, err)
+			msgs = append(msgs, fmt.Sprintf("%s: %s", src, err))
+			continue
+		}
+		twig.Infof("read ngc file using credential source %s\n", src)
+		return bytes, nil
+	}
+	return nil, errors.Errorf("no credential source could read the ngc file:\n%s", strings.Join(msgs, "\n"))
+}
+
+func getNgcObject(svc S3API, input *s3.GetObjectInput) ([]byte, error) {
 	obj, err := svc.GetObject(input)
 	if err != nil {
 		twig.Debug("error from GetObject")
 		return nil, err
 	}
+	defer obj.Body.Close()
 	bytes, err := ioutil.ReadAll(obj.Body)
 	return bytes, err
 }
 
+// MetadataTimeout bounds how long looking up the machine's location in
+// instance metadata can take, so a run off the cloud isn't held up by it.
+var MetadataTimeout = 2 * time.Second
+
+// metadataClient asks the metadata services, which are only ever on the
+// machine's own network and so never go through a proxy.
+var metadataClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 1 * time.Second,
+		}).DialContext,
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: 1 * time.Second,
+	},
+}
+
+// located is what ResolveRegion found. The machine doesn't move during a
+// run, so its metadata is only ever asked once.
+var located struct {
+	sync.Once
+	loc string
+	err error
+}
+
+// ResolveRegion finds the location of the machine, as s3.[region] on
+// amazon or gs.[zone] on google, from the instance metadata of each. Both
+// are asked at once, for no longer than MetadataTimeout altogether, the
+// first time it's called, and later calls give the same answer.
 func ResolveRegion() (string, error) {
-	// Attempt to resolve the location on aws or gs.
-	loc, err := resolveAwsRegion()
-	if err != nil {
-		// could be on google
-		// retain aws error message
-		msg := err.Error()
-		loc, err = resolveGcpZone()
-		if err != nil {
-			// return both aws and google error messages
-			return "", errors.Wrap(err, msg)
+	located.Do(func() {
+		located.loc, located.err = resolveRegion()
+	})
+	return located.loc, located.err
+}
+
+func resolveRegion() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), MetadataTimeout)
+	defer cancel()
+	type result struct {
+		loc string
+		err error
+	}
+	results := make(chan result, 2)
+	for _, probe := range []func(context.Context) (string, error){resolveAwsRegion, resolveGcpZone} {
+		go func(probe func(context.Context) (string, error)) {
+			loc, err := probe(ctx)
+			results <- result{loc, err}
+		}(probe)
+	}
+	var msgs []string
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err == nil {
+			return r.loc, nil
 		}
+		msgs = append(msgs, r.err.Error())
 	}
-	return loc, nil
-}
-
-func resolveAwsRegion() (string, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   1 * time.Second,
-				KeepAlive: 1 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          1000,
-			MaxIdleConnsPerHost:   1000,
-			IdleConnTimeout:       500 * time.Millisecond,
-			TLSHandshakeTimeout:   500 * time.Millisecond,
-			ExpectContinueTimeout: 500 * time.Millisecond,
-		},
-	}
-	// maybe we are on an AWS instance and can resolve what region we are in.
-	// let's try it out and if we timeout we'll return an error.
-	// use this url: http://169.254.169.254/latest/dynamic/instance-identity/document
-	resp, err := client.Get("http://169.254.169.254/latest/dynamic/instance-identity/document")
+	return "", errors.Errorf("location was not provided, fusera attempted to resolve region but encountered an error, this feature only works when fusera is on an amazon or google instance: %s", strings.Join(msgs, "; "))
+}
+
+// DetectLocation is ResolveRegion for when a location is only nice to
+// have: it's empty when none could be found, or what was found isn't a
+// location the Name Resolver API knows.
+func DetectLocation() string {
+	loc, err := ResolveRegion()
 	if err != nil {
-		return "", errors.Wrapf(err, "location was not provided, fusera attempted to resolve region but encountered an error, this feature only works when fusera is on an amazon or google instance")
+		twig.Debugf("going without a location: %s", err)
+		return ""
+	}
+	if !IsLocation(loc) {
+		twig.Debugf("going without a location, found %s which isn't one", loc)
+		return ""
 	}
+	twig.Debugf("found location %s from instance metadata", loc)
+	return loc
+}
+
+func resolveAwsRegion(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", "http://169.254.169.254/latest/dynamic/instance-identity/document", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := metadataClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "amazon")
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return "", errors.Errorf("issue trying to resolve region, got: %d: %s", resp.StatusCode, resp.Status)
 	}
@@ -199,28 +737,17 @@ func resolveAwsRegion() (string, error) {
 	return "s3." + payload.Region, nil
 }
 
-func resolveGcpZone() (string, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   1 * time.Second,
-				KeepAlive: 1 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          1000,
-			MaxIdleConnsPerHost:   1000,
-			IdleConnTimeout:       500 * time.Millisecond,
-			TLSHandshakeTimeout:   500 * time.Millisecond,
-			ExpectContinueTimeout: 500 * time.Millisecond,
-		},
-	}
+func resolveGcpZone(ctx context.Context) (string, error) {
 	req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/zone?alt=json", nil)
+	if err != nil {
+		return "", err
+	}
 	req.Header.Add("Metadata-Flavor", "Google")
-	resp, err := client.Do(req)
+	resp, err := metadataClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", errors.Wrapf(err, "location was not provided, fusera attempted to resolve region but encountered an error, this feature only works when fusera is on an amazon or google instance")
+		return "", errors.Wrap(err, "google")
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return "", errors.Errorf("issue trying to resolve region, got: %d: %s", resp.StatusCode, resp.Status)
 	}
@@ -250,6 +777,10 @@ func parseHTTPError(code int) error {
 	case 405:
 		twig.Debug("converting to ENOTSUP")
 		return syscall.ENOTSUP
+	case 429:
+		// only reached once the retries waiting out Retry-After ran out
+		twig.Debug("rate limited, converting to EAGAIN")
+		return syscall.EAGAIN
 	case 500:
 		twig.Debug("converting to EAGAIN")
 		return syscall.EAGAIN
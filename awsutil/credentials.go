@@ -0,0 +1,88 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// A CredentialSource is one place to get aws credentials from when reading
+// an ngc file.
+//
+// Kind is one of:
+//
+//	default: the sdk's usual chain of environment, shared file, and instance role
+//	env: only the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY environment variables
+//	profile: the named profile, given in Value, of the shared credentials file
+//	role: assume the role whose arn is given in Value, using the default chain
+type CredentialSource struct {
+	Kind  string
+	Value string
+}
+
+func (s CredentialSource) String() string {
+	if s.Value == "" {
+		return s.Kind
+	}
+	return s.Kind + ":" + s.Value
+}
+
+// ParseCredentialSources reads a comma separated list of sources such as
+// "profile:lab,role:arn:aws:iam::123456789012:role/dbgap,default".
+func ParseCredentialSources(spec string) ([]CredentialSource, error) {
+	var sources []CredentialSource
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		kind, value := s, ""
+		if i := strings.Index(s, ":"); i >= 0 {
+			kind, value = s[:i], s[i+1:]
+		}
+		switch kind {
+		case "default", "env":
+			if value != "" {
+				return nil, errors.Errorf("credential source %s doesn't take a value: %s", kind, s)
+			}
+		case "profile", "role":
+			if value == "" {
+				return nil, errors.Errorf("credential source %s needs a value, as in %s:name", kind, kind)
+			}
+		default:
+			return nil, errors.Errorf("unknown credential source: %s, must be one of default, env, profile:[name], or role:[arn]", s)
+		}
+		sources = append(sources, CredentialSource{Kind: kind, Value: value})
+	}
+	return sources, nil
+}
+
+// credentials returns the credentials to use for this source, or nil when
+// the session's default chain should be used.
+func (s CredentialSource) credentials(sess *session.Session) *credentials.Credentials {
+	switch s.Kind {
+	case "env":
+		return credentials.NewEnvCredentials()
+	case "profile":
+		return credentials.NewSharedCredentials("", s.Value)
+	case "role":
+		return stscreds.NewCredentials(sess, s.Value)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// GcsTokenEnv names an environment variable holding an OAuth2 access
+// token to read ngc files from Google Cloud Storage with, such as the
+// output of gcloud auth print-access-token. Without it the token of the
+// instance's service account is used when running on Google Cloud.
+const GcsTokenEnv = "GOOGLE_OAUTH_ACCESS_TOKEN"
+
+// IsGcsURL reports whether path names an object in Google Cloud Storage,
+// either as gs://bucket/object or through storage.googleapis.com.
+func IsGcsURL(path string) bool {
+	_, _, ok := parseGcsURL(path)
+	return ok
+}
+
+// parseGcsURL splits a Google Cloud Storage url into its bucket and object,
+// accepting gs://bucket/object, https://storage.googleapis.com/bucket/object
+// and https://bucket.storage.googleapis.com/object.
+func parseGcsURL(path string) (bucket, object string, ok bool) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", "", false
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	switch {
+	case u.Scheme == "gs":
+		bucket, object = u.Host, p
+	case u.Host == "storage.googleapis.com":
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		bucket, object = parts[0], parts[1]
+	case strings.HasSuffix(u.Host, ".storage.googleapis.com"):
+		bucket, object = strings.TrimSuffix(u.Host, ".storage.googleapis.com"), p
+	default:
+		return "", "", false
+	}
+	return bucket, object, bucket != "" && object != ""
+}
+
+// readGcsNgcFile downloads an ngc file from Google Cloud Storage through
+// its JSON API, authenticated by the token from gcsToken when there is one.
+func readGcsNgcFile(path string) ([]byte, error) {
+	bucket, object, ok := parseGcsURL(path)
+	if !ok {
+		return nil, errors.Errorf("url did not point to a valid google cloud storage object, expected gs://[bucket]/[file]: %s", path)
+	}
+	twig.Debugf("bucket: %s", bucket)
+	twig.Debugf("file: %s", object)
+	req, err := http.NewRequest("GET", "https://storage.googleapis.com/storage/v1/b/"+url.PathEscape(bucket)+"/o/"+url.PathEscape(object)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if token := gcsToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		twig.Debug("no google credentials found, reading ngc file anonymously")
+	}
+	resp, err := DefaultClient.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("google cloud storage refused to give ngc file: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// gcsToken finds an access token for Google Cloud Storage, first from
+// GcsTokenEnv then from the metadata server of a Google Cloud instance,
+// which is asked without going through any proxy.
+func gcsToken() string {
+	if token := os.Getenv(GcsTokenEnv); token != "" {
+		return token
+	}
+	// whether this is a google instance at all is only looked up once, so
+	// reading ngc files off the cloud isn't held up on every one of them
+	if loc, err := ResolveRegion(); err != nil || !strings.HasPrefix(loc, "gs.") {
+		twig.Debug("not on a google instance, no service account token to get")
+		return ""
+	}
+	req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	ctx, cancel := context.WithTimeout(context.Background(), MetadataTimeout)
+	defer cancel()
+	resp, err := metadataClient.Do(req.WithContext(ctx))
+	if err != nil {
+		twig.Debugf("couldn't get a token from the google metadata server: %s", err)
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		twig.Debugf("google metadata server gave no token: %s", resp.Status)
+		return ""
+	}
+	var payload struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		twig.Debugf("couldn't decode token from the google metadata server: %s", err)
+		return ""
+	}
+	return payload.AccessToken
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The limits below are shared by every request made through
+// ReadObjectRange and StreamObjectRange, however many files and parts of
+// files are being fetched at once, so stacking up parallelism can't go
+// past them. Requests whose body is left to the caller aren't counted,
+// since an idle body could hold its place forever.
+
+// slots bounds the requests in flight, nil meaning no bound.
+var slots chan struct{}
+
+// bandwidth throttles the bytes read from every body, nil meaning no throttle.
+var bandwidth *bucket
+
+// SetMaxConnections bounds how many requests may be in flight at once,
+// so parallel downloads can't exhaust the connection pool. Zero or less
+// removes the bound. It should be called before any requests are made.
+func SetMaxConnections(n int) {
+	if n <= 0 {
+		slots = nil
+		return
+	}
+	slots = make(chan struct{}, n)
+}
+
+// MaxConnsPerHost caps the connections, busy or idle, that requests for
+// objects keep open to any one host, so that a highly parallel download
+// stays under what s3 or NCBI will take before throttling. Requests past
+// the cap wait for a connection to free up. Zero leaves it uncapped.
+var MaxConnsPerHost = 128
+
+// SetMaxConnsPerHost sets MaxConnsPerHost for DefaultClient's requests
+// from now on.
+func SetMaxConnsPerHost(n int) {
+	MaxConnsPerHost = n
+	DefaultClient.HTTP = NewClient().HTTP
+}
+
+// SetRateLimit caps the bytes per second read across all requests. Zero
+// or less removes the cap. It should be called before any requests are made.
+func SetRateLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		bandwidth = nil
+		return
+	}
+	bandwidth = newBucket(bytesPerSecond)
+}
+
+func acquireSlot() {
+	if slots != nil {
+		slots <- struct{}{}
+	}
+}
+
+func releaseSlot() {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// bucket is a token bucket holding up to a second's worth of bytes.
+// Readers take out what they read and wait when they've taken more than
+// is there, so all of them together stay under the rate.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *bucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	// whoever goes into debt waits it out, holding back the rest
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// throttledBody reads within the shared bandwidth and gives back its
+// request's slot when closed.
+type throttledBody struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+// the most read at once, so no reader takes a long turn
+const throttleChunk = 32 * 1024
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if bandwidth == nil {
+		return b.ReadCloser.Read(p)
+	}
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	bandwidth.take(n)
+	return n, err
+}
+
+func (b *throttledBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(releaseSlot)
+	return err
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress is told how many bytes of a download are on disk so far and how
+// many there are in all, -1 when the server didn't say. It's called from
+// the goroutines doing the download, one call at a time, so it should
+// return quickly.
+type Progress func(done, total int64)
+
+// ProgressInterval is the least time between two calls of a Progress.
+// A last call is always made once a download completes.
+var ProgressInterval = time.Second
+
+// progressCounter counts the bytes written to it and passes them on to a
+// Progress no more often than ProgressInterval. A nil one counts nothing.
+type progressCounter struct {
+	fn Progress
+
+	mu    sync.Mutex
+	done  int64
+	total int64
+	last  time.Time
+}
+
+func newProgressCounter(fn Progress) *progressCounter {
+	if fn == nil {
+		return nil
+	}
+	return &progressCounter{fn: fn, total: -1}
+}
+
+// reset starts the count over from done bytes of total.
+func (p *progressCounter) reset(done, total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done, p.total = done, total
+}
+
+// skip counts n bytes that were already there, without reporting them.
+func (p *progressCounter) skip(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+}
+
+func (p *progressCounter) Write(b []byte) (int, error) {
+	if p == nil {
+		return len(b), nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= ProgressInterval {
+		p.last = now
+		p.fn(p.done, p.total)
+	}
+	return len(b), nil
+}
+
+// finish reports the final count, whenever the last one was.
+func (p *progressCounter) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fn(p.done, p.total)
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// RangeChunkSize is how much of an object a RangeReader asks for at a time.
+// It's kept small since random access readers rarely want much past
+// where they asked.
+const RangeChunkSize = 1024 * 1024
+
+// RangeReader reads an object in fixed size chunks over several
+// connections at once. Reading at an offset fetches the chunk holding it
+// along with the chunks that follow, in parallel, so scattered reads
+// mostly find their data already on its way.
+type RangeReader struct {
+	// Link is asked for the url before every request, so a signed url
+	// that gets renewed is used from then on.
+	Link func() (string, error)
+	// Renew, when set, is given the url a chunk's request was refused
+	// with and asked for a fresh one, and the chunk is asked for once more
+	// with it. Chunks refused together each ask, so Renew should hand back
+	// the url that already replaced refused rather than renew it again.
+	Renew func(refused string) (string, error)
+	Size  int64
+	// Connections is how many chunks are fetched at once.
+	Connections int
+
+	mu sync.Mutex
+	// chunks fetched or being fetched by index, oldest first in order
+	chunks map[int64]*rangeChunk
+	order  []int64
+}
+
+type rangeChunk struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewRangeReader returns a RangeReader for the object of size bytes at
+// the url link returns, using connections concurrent requests.
+func NewRangeReader(link func() (string, error), size int64, connections int) *RangeReader {
+	if connections < 1 {
+		connections = 1
+	}
+	return &RangeReader{
+		Link:        link,
+		Size:        size,
+		Connections: connections,
+		chunks:      make(map[int64]*rangeChunk),
+	}
+}
+
+// ReadAt reads len(p) bytes into p from off, across as many chunks as
+// that takes, as an io.ReaderAt does. It's short only with an error, which
+// is io.EOF when the object ends first.
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := r.readChunk(p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readChunk reads into p from off what the chunk holding off has, so it
+// can come back short without an error; io.EOF means off is past the end.
+func (r *RangeReader) readChunk(p []byte, off int64) (int, error) {
+	if off >= r.Size {
+		return 0, io.EOF
+	}
+	idx := off / RangeChunkSize
+	r.mu.Lock()
+	c := r.fetch(idx)
+	for i := idx + 1; i < idx+int64(r.Connections) && i*RangeChunkSize < r.Size; i++ {
+		r.fetch(i)
+	}
+	r.mu.Unlock()
+
+	<-c.done
+	if c.err != nil {
+		// don't keep the failure around, the next read can try again,
+		// unless another read already has
+		r.mu.Lock()
+		if r.chunks[idx] == c {
+			r.forget(idx)
+		}
+		r.mu.Unlock()
+		return 0, c.err
+	}
+	return copy(p, c.data[off-idx*RangeChunkSize:]), nil
+}
+
+// Close drops all the chunks held. Fetches still in flight finish on their own.
+func (r *RangeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = make(map[int64]*rangeChunk)
+	r.order = nil
+	return nil
+}
+
+// fetch returns chunk idx, starting to fetch it if that hasn't happened yet.
+// LOCKS_REQUIRED(r.mu)
+func (r *RangeReader) fetch(idx int64) *rangeChunk {
+	if c, ok := r.chunks[idx]; ok {
+		return c
+	}
+	// Twice the window stays cached, so going back a little is free.
+	for len(r.order) >= 2*r.Connections {
+		r.forget(r.order[0])
+	}
+	c := &rangeChunk{done: make(chan struct{})}
+	r.chunks[idx] = c
+	r.order = append(r.order, idx)
+	go r.get(idx, c)
+	return c
+}
+
+// LOCKS_REQUIRED(r.mu)
+func (r *RangeReader) forget(idx int64) {
+	delete(r.chunks, idx)
+	for i, v := range r.order {
+		if v == idx {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *RangeReader) get(idx int64, c *rangeChunk) {
+	defer close(c.done)
+	start := idx * RangeChunkSize
+	end := start + RangeChunkSize
+	if end > r.Size {
+		end = r.Size
+	}
+	link, err := r.Link()
+	if err != nil {
+		c.err = err
+		return
+	}
+	twig.Debugf("fetching bytes %d-%d", start, end-1)
+	data, err := ReadObjectRange(link, fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if Refused(err) && r.Renew != nil {
+		if link, rerr := r.Renew(link); rerr == nil {
+			data, err = ReadObjectRange(link, fmt.Sprintf("bytes=%d-%d", start, end-1))
+		}
+	}
+	if err != nil {
+		c.err = err
+		return
+	}
+	if int64(len(data)) != end-start {
+		c.err = errors.Errorf("got %d bytes of %d-%d", len(data), start, end-1)
+		return
+	}
+	c.data = data
+}
@@ -0,0 +1,325 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// ReadObjectRange makes the same request as GetObjectRange and returns
+// the whole body, which is always closed.
+func ReadObjectRange(url, byteRange string) ([]byte, error) {
+	body, err := openObjectRange(context.Background(), url, byteRange)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// StreamObjectRange makes the same request as GetObjectRange and copies
+// the body to w, always closing it.
+func StreamObjectRange(url, byteRange string, w io.Writer) error {
+	return streamObjectRange(context.Background(), url, byteRange, w)
+}
+
+func streamObjectRange(ctx context.Context, url, byteRange string, w io.Writer) error {
+	body, err := openObjectRange(ctx, url, byteRange)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = copyBody(w, body)
+	return err
+}
+
+// Bounds on CopyBufferSize. Below io.Copy's own 32KiB a transfer only
+// gets slower, and beyond a few MiB it stops getting faster while every
+// download in flight holds a buffer of that size.
+const (
+	MinCopyBufferSize = 32 * 1024
+	MaxCopyBufferSize = 64 * 1024 * 1024
+)
+
+// CopyBufferSize is how much of a body is read at a time on its way into a
+// file. A large one makes for fewer, bigger writes, which keeps up better
+// with a fast link.
+var CopyBufferSize = 1024 * 1024
+
+// copyBody copies src to dst through a buffer of CopyBufferSize.
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	return io.CopyBuffer(dst, src, make([]byte, CopyBufferSize))
+}
+
+// TransferStats is what a download into a file measured of itself.
+type TransferStats struct {
+	// BytesWritten counts what arrived over the network this time, not
+	// what was already on disk from an earlier attempt.
+	BytesWritten int64
+	Duration     time.Duration
+	// Retries is how many times the download was picked up again after
+	// the response ended early. Requests retried on the way, by the shared
+	// policy, aren't counted.
+	Retries int
+	// Checksum is the hex md5 of the whole file, when it was worked out.
+	Checksum string
+}
+
+// GetObjectToFile downloads the whole object at url to dest. It's written
+// to dest.part first and renamed once complete, so an interrupted download
+// never leaves a partial file under the real name. A dest.part left by an
+// earlier attempt is resumed from where it stopped, when the server honors
+// a range, and otherwise started over.
+// The md5 of the file is worked out as it's written and returned as the
+// stats' Checksum, so it never has to be read back. When md5sum isn't empty it's
+// checked before the rename, and a download that doesn't match is removed
+// so the next try starts over. A body that ends short of the length the
+// server gave is resumed straight away, up to MaxRetries times. A non-nil
+// progress is kept up to date with how much of the file is on disk.
+func GetObjectToFile(url, dest, md5sum string, progress Progress) (TransferStats, error) {
+	return GetObjectToFileContext(context.Background(), url, dest, md5sum, progress)
+}
+
+// GetObjectToFileContext is GetObjectToFile bounded by ctx. What arrived
+// before ctx was done is kept in dest.part like after any other failure.
+func GetObjectToFileContext(ctx context.Context, url, dest, md5sum string, progress Progress) (TransferStats, error) {
+	var stats TransferStats
+	start := time.Now()
+	part := dest + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return stats, err
+	}
+	h := md5.New()
+	pc := newProgressCounter(progress)
+	for try := 0; ; try++ {
+		var n int64
+		n, err = resumeObject(ctx, url, f, h, pc)
+		stats.BytesWritten += n
+		if errors.Cause(err) != ErrIncomplete || try >= MaxRetries || ctx.Err() != nil {
+			break
+		}
+		twig.Debugf("%s of %s, resuming it", err, dest)
+		stats.Retries++
+		// resuming hashes all that's on disk again
+		h.Reset()
+	}
+	stats.Duration = time.Since(start)
+	if err == nil {
+		// flushed once, just before the rename, so a crash after it can't
+		// leave dest short
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// keep what arrived for next time
+		return stats, err
+	}
+	pc.finish()
+	got := hex.EncodeToString(h.Sum(nil))
+	if md5sum != "" && !strings.EqualFold(got, md5sum) {
+		os.Remove(part)
+		return stats, errors.Wrapf(ErrChecksumMismatch, "%s: expected md5 %s, got %s", dest, md5sum, got)
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return stats, err
+	}
+	stats.Checksum = got
+	return stats, SyncDir(filepath.Dir(dest))
+}
+
+// SyncDir flushes the entries of the directory at path, making a file just
+// renamed into it stay renamed through a crash.
+func SyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SyncFile flushes the contents of the file at path to disk.
+func SyncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// resumeObject appends the rest of the object at url to f, writing all of
+// f's contents to h along the way and counting them with pc. The existing
+// contents are only dropped once the server has answered with the whole
+// object. It returns how many bytes arrived, even when it fails.
+func resumeObject(ctx context.Context, url string, f *os.File, h io.Writer, pc *progressCounter) (int64, error) {
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	var resp *http.Response
+	if off > 0 {
+		resp, err = openObject(ctx, url, fmt.Sprintf("bytes=%d-", off))
+		if err != nil {
+			twig.Debugf("couldn't resume %s from byte %d, starting over: %s", f.Name(), off, err)
+			resp = nil
+		} else if resp.StatusCode != http.StatusPartialContent {
+			twig.Debugf("server sent all of %s instead of resuming it, starting over", f.Name())
+			off = 0
+		}
+	}
+	if resp == nil {
+		off = 0
+		if resp, err = openObject(ctx, url, ""); err != nil {
+			return 0, err
+		}
+	}
+	defer resp.Body.Close()
+	if off == 0 {
+		if err := f.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	} else {
+		twig.Debugf("resuming %s from byte %d", f.Name(), off)
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, off)); err != nil {
+			return 0, err
+		}
+	}
+	total := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		total = contentRangeTotal(resp.Header.Get("Content-Range"))
+	}
+	pc.reset(off, total)
+	n, err := copyBody(io.MultiWriter(f, h, pc), resp.Body)
+	if err == io.ErrUnexpectedEOF {
+		// what net/http makes of a connection closed early
+		return n, errors.Wrapf(ErrIncomplete, "got %d of %d bytes", off+n, total)
+	}
+	if err != nil {
+		return n, err
+	}
+	if total >= 0 && off+n != total {
+		return n, errors.Wrapf(ErrIncomplete, "got %d of %d bytes", off+n, total)
+	}
+	return n, nil
+}
+
+// ErrIncomplete is the cause of the error when a response's body ends
+// before as many bytes as the server said it would hold have arrived.
+var ErrIncomplete = errors.New("response ended early")
+
+// contentRangeTotal is the size of the whole object from a Content-Range
+// header like bytes 100-199/1000, or -1 when it isn't given.
+func contentRangeTotal(v string) int64 {
+	i := strings.LastIndex(v, "/")
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(v[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+// openObject makes the request of GetObjectRange, holding a slot of those
+// set with SetMaxConnections and throttled by SetRateLimit until the body
+// is closed.
+func openObject(ctx context.Context, url, byteRange string) (*http.Response, error) {
+	acquireSlot()
+	resp, err := DefaultClient.GetObjectRangeContext(ctx, url, byteRange)
+	if err != nil {
+		releaseSlot()
+		return nil, err
+	}
+	resp.Body = &throttledBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+// openObjectRange returns the body of a ranged GET holding just the bytes
+// asked for. A server is allowed to ignore a range and send the whole
+// object instead, which is only usable when the range starts at the
+// beginning, and then only up to where the range ends.
+func openObjectRange(ctx context.Context, url, byteRange string) (io.ReadCloser, error) {
+	resp, err := openObject(ctx, url, byteRange)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.Body
+	if byteRange == "" || resp.StatusCode != http.StatusOK {
+		return body, nil
+	}
+	start, end, ok := parseRange(byteRange)
+	if !ok || start != 0 {
+		body.Close()
+		return nil, errors.Errorf("server ignored the requested range: %s", byteRange)
+	}
+	if end < 0 {
+		return body, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, end+1), body}, nil
+}
+
+// parseRange reads a single range header of the form bytes=start-end,
+// where end can be left off, in which case it's returned as -1.
+func parseRange(byteRange string) (start, end int64, ok bool) {
+	if !strings.HasPrefix(byteRange, "bytes=") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(byteRange, "bytes="), "-", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if parts[1] == "" {
+		return start, -1, true
+	}
+	end, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
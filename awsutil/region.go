@@ -0,0 +1,143 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RedactURL strips the query string, which holds the signature of a
+// signed url, and any user info from link so that it's safe to log.
+// The scheme, host, and path are kept.
+func RedactURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "<unparseable url>"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// signedQuery is a query string carrying a signature, of any of s3's
+// signing versions or a google signed url, up to where the url ends.
+var signedQuery = regexp.MustCompile(`(?i)\?[^\s"'<>]*Signature=[^\s"'<>]*`)
+
+// RedactSignatures strips the query string from every signed url in s,
+// such as the text of an error that may quote one, so that it's safe to
+// send anywhere.
+func RedactSignatures(s string) string {
+	return signedQuery.ReplaceAllString(s, "")
+}
+
+// Host returns the host link points at, or an empty string.
+func Host(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// InferRegion works out where the data behind link is served from, in
+// the same [service].[region] form used for locations, so that traffic
+// can be tallied the way cloud providers bill egress. When the region
+// can't be found only the service is returned, and "unknown" when even
+// that can't be.
+func InferRegion(service, link string) string {
+	if strings.Contains(service, ".") {
+		return service
+	}
+	host := strings.ToLower(Host(link))
+	switch {
+	case strings.HasSuffix(host, "amazonaws.com"):
+		return "s3." + s3Region(host)
+	case host == "storage.googleapis.com" || strings.HasSuffix(host, ".storage.googleapis.com"):
+		return "gs"
+	case strings.HasSuffix(host, "ncbi.nlm.nih.gov"):
+		return "ncbi"
+	}
+	if service != "" {
+		return service
+	}
+	return "unknown"
+}
+
+// s3Region picks the region out of the forms an S3 host comes in:
+// s3.amazonaws.com, s3.[region].amazonaws.com, s3-[region].amazonaws.com,
+// s3.dualstack.[region].amazonaws.com, each optionally prefixed with a
+// bucket, and s3-accelerate.amazonaws.com or its dualstack form, which
+// has no region and is billed as "accelerate". The bucket can hold dots
+// and s3- labels of its own, so the host is read from the right.
+func s3Region(host string) string {
+	sections := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+	for i := len(sections) - 1; i >= 0; i-- {
+		s := sections[i]
+		switch {
+		case s == "s3-accelerate":
+			return "accelerate"
+		case s == "s3":
+			rest := sections[i+1:]
+			if len(rest) > 0 && rest[0] == "dualstack" {
+				rest = rest[1:]
+			}
+			if len(rest) > 0 {
+				return rest[0]
+			}
+			// the legacy global endpoint
+			return "us-east-1"
+		case s == "s3-external-1":
+			return "us-east-1"
+		case strings.HasPrefix(s, "s3-"):
+			return strings.TrimPrefix(s, "s3-")
+		}
+	}
+	return "us-east-1"
+}
+
+// LocationWarning looks at where the files resolved for loc will be served
+// from, given as regions in the form InferRegion returns, and describes
+// the problem when some of them only come from NCBI's public servers even
+// though this machine is in a cloud region that could have served them.
+// Downloading those means public egress, which is slow and can be costly,
+// and is usually down to a wrong or missing location. It returns an empty
+// string when there's nothing to warn about.
+func LocationWarning(loc string, regions []string) string {
+	public := 0
+	for _, r := range regions {
+		if strings.Contains(r, "ncbi") {
+			public++
+		}
+	}
+	if public == 0 {
+		return ""
+	}
+	// Off the cloud public servers are the only way to get the data, so
+	// only look for a better location once some files are known to be
+	// public. A run that already went looking for its location gets the
+	// answer it found then, without waiting on the metadata again.
+	here, err := ResolveRegion()
+	if err != nil {
+		return ""
+	}
+	if here != loc {
+		return fmt.Sprintf("WARNING: %d of %d files will be downloaded from NCBI's public servers, which is slow and can incur egress charges. "+
+			"This machine appears to be in %s but the location used was %q, try --loc %s", public, len(regions), here, loc, here)
+	}
+	return fmt.Sprintf("WARNING: %d of %d files have no copy in %s and will be downloaded from NCBI's public servers, which is slow and can incur egress charges.", public, len(regions), loc)
+}
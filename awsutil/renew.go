@@ -0,0 +1,57 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"net/http"
+	"syscall"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// Refused reports whether err is a request being refused, a 403 from the
+// server or what was made of one.
+func Refused(err error) bool {
+	return errors.Cause(err) == syscall.EACCES
+}
+
+// Retry calls fetch with url and, if that's refused and c can renew urls,
+// once more with a fresh one. It returns the url that was tried last, for
+// the caller to keep using.
+func (c *Client) Retry(acc, name, url string, fetch func(url string) error) (string, error) {
+	err := fetch(url)
+	if err == nil || c == nil || c.Renew == nil || !Refused(err) {
+		return url, err
+	}
+	twig.Debugf("url for %s/%s was refused, renewing it", acc, name)
+	fresh, rerr := c.Renew(acc, name)
+	if rerr != nil {
+		twig.Debugf("couldn't renew url for %s/%s: %s", acc, name, rerr)
+		return url, err
+	}
+	return fresh, fetch(fresh)
+}
+
+// GetFileRange is GetObjectRange for the file name of accession acc,
+// renewing url once if it's refused. It returns the url that worked.
+func (c *Client) GetFileRange(acc, name, url, byteRange string) (*http.Response, string, error) {
+	var resp *http.Response
+	url, err := c.Retry(acc, name, url, func(url string) error {
+		var err error
+		resp, err = c.GetObjectRange(url, byteRange)
+		return err
+	})
+	return resp, url, err
+}
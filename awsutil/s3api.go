@@ -0,0 +1,50 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3API is what of the s3 client reading ngc files and copying into a
+// bucket takes, so that a stub can stand in for it.
+type S3API interface {
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	GetBucketLocation(*s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error)
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+	CreateMultipartUploadWithContext(aws.Context, *s3.CreateMultipartUploadInput, ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartWithContext(aws.Context, *s3.UploadPartInput, ...request.Option) (*s3.UploadPartOutput, error)
+	CompleteMultipartUploadWithContext(aws.Context, *s3.CompleteMultipartUploadInput, ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(*s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// session is the session of c's requests to s3 in region.
+func (c *Client) session(region string) *session.Session {
+	if c != nil && c.Session != nil {
+		return c.Session(region)
+	}
+	return newSession(region)
+}
+
+// s3 is the client c talks to s3 with over sess.
+func (c *Client) s3(sess *session.Session, cfgs ...*aws.Config) S3API {
+	if c != nil && c.S3 != nil {
+		return c.S3(sess, cfgs...)
+	}
+	return s3.New(sess, cfgs...)
+}
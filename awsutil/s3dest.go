@@ -0,0 +1,285 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// S3PartSize is the size of the parts an object is uploaded to s3 in. Each
+// part is held in memory until it's sent, so it's also how much memory every
+// copy in flight takes. An object too big for it to fit in 10000 parts, the
+// most s3 allows, gets bigger ones.
+var S3PartSize int64 = 16 * 1024 * 1024
+
+const maxS3Parts = 10000
+
+// S3Dest is a bucket, and a prefix within it, that objects are copied into
+// straight from their signed urls without going through the local disk.
+type S3Dest struct {
+	Bucket string
+	Prefix string
+
+	svc S3API
+}
+
+// NewS3Dest connects to the destination dest, an s3://bucket/prefix url,
+// with DefaultClient.
+func NewS3Dest(dest string) (*S3Dest, error) {
+	return DefaultClient.NewS3Dest(dest)
+}
+
+// NewS3DestWith connects to the destination dest with DefaultClient, see
+// Client.NewS3DestWith.
+func NewS3DestWith(dest string, sources []CredentialSource) (*S3Dest, error) {
+	return DefaultClient.NewS3DestWith(dest, sources)
+}
+
+// NewS3Dest connects to the destination dest in the region the bucket is
+// in, over c's session for it.
+func (c *Client) NewS3Dest(dest string) (*S3Dest, error) {
+	return c.NewS3DestWith(dest, nil)
+}
+
+// NewS3DestWith is NewS3Dest with credentials from the first of sources
+// that can find the bucket, the same sources an ngc file is read with. No
+// sources means the default chain.
+func (c *Client) NewS3DestWith(dest string, sources []CredentialSource) (*S3Dest, error) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, errors.Errorf("destination must look like s3://bucket/prefix: %s", dest)
+	}
+	d := &S3Dest{Bucket: u.Host, Prefix: strings.Trim(u.Path, "/")}
+	if len(sources) == 0 {
+		sources = []CredentialSource{{Kind: "default"}}
+	}
+	var msgs []string
+	for _, src := range sources {
+		var cfgs []*aws.Config
+		if creds := src.credentials(c.session("us-east-1")); creds != nil {
+			cfgs = append(cfgs, &aws.Config{Credentials: creds})
+		}
+		region, err := c.bucketRegion(d.Bucket, cfgs...)
+		if err != nil {
+			if len(sources) == 1 {
+				return nil, err
+			}
+			twig.Debugf("credential source %s couldn't find bucket %s: %s", src, d.Bucket, err)
+			msgs = append(msgs, fmt.Sprintf("%s: %s", src, err))
+			continue
+		}
+		twig.Debugf("copying into bucket %s in %s using credential source %s", d.Bucket, region, src)
+		d.svc = c.s3(c.session(region), cfgs...)
+		return d, nil
+	}
+	return nil, errors.Errorf("no credential source could find bucket %s:\n%s", d.Bucket, strings.Join(msgs, "\n"))
+}
+
+// bucketRegion asks s3 where bucket is, which any region can answer.
+func (c *Client) bucketRegion(bucket string, cfgs ...*aws.Config) (string, error) {
+	out, err := c.s3(c.session("us-east-1"), cfgs...).GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't find the region of bucket %s", bucket)
+	}
+	switch region := aws.StringValue(out.LocationConstraint); region {
+	case "":
+		return "us-east-1", nil
+	case "EU":
+		return "eu-west-1", nil
+	default:
+		return region, nil
+	}
+}
+
+// Key is where the file name of accession acc is copied to, keeping the
+// same accession/name layout as a copy to disk.
+func (d *S3Dest) Key(acc, name string) string {
+	return path.Join(d.Prefix, acc, name)
+}
+
+// URL is the s3:// url of key.
+func (d *S3Dest) URL(key string) string {
+	return "s3://" + d.Bucket + "/" + key
+}
+
+// CopyObject streams the object at url into key, in one PutObject when it
+// fits in a single part and as a multipart upload otherwise, with its md5
+// as the stats' Checksum. size is how big the object is said to be,
+// 0 when that isn't known, and only decides the part size.
+// Nothing is left at key unless all of the object arrived: a body ending
+// short of its Content-Length, or one that doesn't match md5sum when that
+// isn't empty, fails the copy, and a multipart upload that fails is aborted.
+func (d *S3Dest) CopyObject(ctx context.Context, url, key string, size int64, md5sum string, progress Progress) (TransferStats, error) {
+	start := time.Now()
+	sum, n, err := d.copyObject(ctx, url, key, size, md5sum, progress)
+	return TransferStats{BytesWritten: n, Duration: time.Since(start), Checksum: sum}, err
+}
+
+func (d *S3Dest) copyObject(ctx context.Context, url, key string, size int64, md5sum string, progress Progress) (string, int64, error) {
+	resp, err := openObject(ctx, url, "")
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	partSize := S3PartSize
+	if size > partSize*maxS3Parts {
+		partSize = (size + maxS3Parts - 1) / maxS3Parts
+	}
+	pc := newProgressCounter(progress)
+	pc.reset(0, resp.ContentLength)
+	h := md5.New()
+	c := &s3Copy{dest: d, key: key, want: resp.ContentLength, md5sum: md5sum, h: h}
+	body := io.TeeReader(resp.Body, io.MultiWriter(h, pc))
+	buf := make([]byte, partSize)
+	n, err := readPart(body, buf)
+	if err != nil {
+		return "", 0, err
+	}
+	if n < len(buf) {
+		// all of it fit in one part
+		got, err := c.check(int64(n))
+		if err != nil {
+			return "", 0, err
+		}
+		if _, err := d.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(d.Bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(buf[:n]),
+		}); err != nil {
+			return "", 0, errors.Wrapf(err, "couldn't put %s", d.URL(key))
+		}
+		pc.finish()
+		return got, int64(n), nil
+	}
+	got, total, err := c.multipart(ctx, body, buf, n)
+	if err != nil {
+		return "", 0, err
+	}
+	pc.finish()
+	return got, total, nil
+}
+
+// s3Copy is a single object being copied into an S3Dest.
+type s3Copy struct {
+	dest *S3Dest
+	key  string
+	// the Content-Length of the object, -1 if it wasn't given
+	want   int64
+	md5sum string
+	h      hash.Hash
+}
+
+// check makes sure all total bytes of the object arrived intact, returning
+// their md5.
+func (c *s3Copy) check(total int64) (string, error) {
+	if c.want >= 0 && total != c.want {
+		return "", errors.Wrapf(ErrIncomplete, "got %d of %d bytes", total, c.want)
+	}
+	got := hex.EncodeToString(c.h.Sum(nil))
+	if c.md5sum != "" && !strings.EqualFold(got, c.md5sum) {
+		return "", errors.Wrapf(ErrChecksumMismatch, "%s: expected md5 %s, got %s", c.dest.URL(c.key), c.md5sum, got)
+	}
+	return got, nil
+}
+
+// multipart uploads the first n bytes of buf and then the rest of body,
+// a buffer at a time.
+func (c *s3Copy) multipart(ctx context.Context, body io.Reader, buf []byte, n int) (string, int64, error) {
+	d := c.dest
+	up, err := d.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(c.key),
+	})
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "couldn't start upload of %s", d.URL(c.key))
+	}
+	abort := func(err error) (string, int64, error) {
+		// not under ctx, it may be why the upload failed
+		if _, aerr := d.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(d.Bucket),
+			Key:      aws.String(c.key),
+			UploadId: up.UploadId,
+		}); aerr != nil {
+			twig.Debugf("couldn't abort upload of %s: %s", d.URL(c.key), aerr)
+		}
+		return "", 0, err
+	}
+	var parts []*s3.CompletedPart
+	var total int64
+	for num := int64(1); n > 0; num++ {
+		out, err := d.svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(d.Bucket),
+			Key:        aws.String(c.key),
+			UploadId:   up.UploadId,
+			PartNumber: aws.Int64(num),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			return abort(errors.Wrapf(err, "couldn't upload part %d of %s", num, d.URL(c.key)))
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(num)})
+		total += int64(n)
+		if n, err = readPart(body, buf); err != nil {
+			return abort(err)
+		}
+	}
+	got, err := c.check(total)
+	if err != nil {
+		return abort(err)
+	}
+	if _, err := d.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.Bucket),
+		Key:             aws.String(c.key),
+		UploadId:        up.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return abort(errors.Wrapf(err, "couldn't finish upload of %s", d.URL(c.key)))
+	}
+	return got, total, nil
+}
+
+// readPart fills as much of buf as body has left, which is short only at
+// its end. Whether the end came too soon is for s3Copy.check to decide.
+func readPart(body io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Has reports whether key already holds an object of size bytes, or of any
+// size when size is 0.
+func (d *S3Dest) Has(key string, size int64) bool {
+	out, err := d.svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(d.Bucket), Key: aws.String(key)})
+	if err != nil {
+		return false
+	}
+	return size == 0 || aws.Int64Value(out.ContentLength) == size
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// splitState is what's kept on disk next to a split download, so that
+// an interrupted one only has to fetch the parts it didn't finish.
+type splitState struct {
+	Size     int64 `json:"size"`
+	PartSize int64 `json:"partSize"`
+	// hex md5 of each part that has been written, empty if it hasn't
+	Done []string `json:"done"`
+}
+
+func (s *splitState) part(i int) (start, end int64) {
+	start = int64(i) * s.PartSize
+	end = start + s.PartSize
+	if end > s.Size {
+		end = s.Size
+	}
+	return
+}
+
+func splitStatePath(path string) string {
+	return path + ".parts"
+}
+
+// RangeSize reports whether the server of url takes range requests, and
+// how big the object there is, both of which DownloadSplit relies on. It
+// asks with a HEAD, looking for Accept-Ranges: bytes and a Content-Length.
+// A url signed for GET alone refuses a HEAD, so then the first byte is
+// asked for instead, and a 206 with the size in its Content-Range will do.
+func RangeSize(ctx context.Context, url string) (int64, bool) {
+	if info, err := DefaultClient.HeadObjectInfo(ctx, url); err == nil {
+		if !info.AcceptsRanges || info.Size <= 0 {
+			twig.Debugf("%s doesn't advertise ranges", Host(url))
+			return 0, false
+		}
+		return info.Size, true
+	}
+	resp, err := openObject(ctx, url, "bytes=0-0")
+	if err != nil {
+		return 0, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		twig.Debugf("%s ignored a range request", Host(url))
+		return 0, false
+	}
+	size := contentRangeTotal(resp.Header.Get("Content-Range"))
+	return size, size > 0
+}
+
+// DownloadSplit fetches the object at link, size bytes long, into path
+// over parts concurrent ranged GETs, each written at its offset in
+// path.part, which is renamed to path once it's complete, as with
+// GetObjectToFile. Progress is recorded in path.parts as each part
+// finishes, so calling it again after an interruption fetches only the
+// parts still missing, once those already on disk are checked to be as
+// they were left. When md5 isn't empty the whole file is checked against
+// it before the rename, and both files are removed if it doesn't match so
+// the next attempt starts over, and otherwise it's the stats' Checksum.
+// The state file is removed once the download is complete.
+// A non-nil progress is told about the bytes of every part together.
+func DownloadSplit(link, path string, size int64, parts int, md5 string, progress Progress) (TransferStats, error) {
+	return DownloadSplitContext(context.Background(), link, path, size, parts, md5, progress)
+}
+
+// DownloadSplitContext is DownloadSplit bounded by ctx. The parts that
+// were done by the time it was are kept to resume from.
+func DownloadSplitContext(ctx context.Context, link, path string, size int64, parts int, md5 string, progress Progress) (TransferStats, error) {
+	var stats TransferStats
+	start := time.Now()
+	if parts < 1 {
+		parts = 1
+	}
+	partSize := (size + int64(parts) - 1) / int64(parts)
+	if partSize == 0 {
+		partSize = 1
+	}
+	state := loadSplitState(path, size, partSize)
+	if state == nil {
+		state = &splitState{Size: size, PartSize: partSize, Done: make([]string, parts)}
+	}
+	part := path + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return stats, err
+	}
+	// closed once the parts are all in, checking the error, and here on
+	// the way out of every failure before that
+	closed := false
+	defer func() {
+		if !closed {
+			f.Close()
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		return stats, errors.Wrapf(err, "couldn't allocate %s", part)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(state.Done))
+	pc := newProgressCounter(progress)
+	pc.reset(0, size)
+	for i := range state.Done {
+		start, end := state.part(i)
+		if start >= end {
+			continue
+		}
+		if state.Done[i] != "" {
+			if sum, err := sectionMD5(f, start, end); err == nil && sum == state.Done[i] {
+				twig.Debugf("part %d of %s is already done", i, path)
+				pc.skip(end - start)
+				continue
+			}
+			twig.Debugf("part %d of %s changed on disk since it was written, fetching it again", i, path)
+			state.Done[i] = ""
+		}
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			sum, n, err := fetchPart(ctx, link, f, start, end, pc)
+			mu.Lock()
+			defer mu.Unlock()
+			stats.BytesWritten += n
+			if err != nil {
+				errs[i] = errors.Wrapf(err, "part %d", i)
+				return
+			}
+			state.Done[i] = sum
+			if err := saveSplitState(path, state); err != nil {
+				twig.Debugf("couldn't save progress of %s: %s", path, err)
+			}
+		}(i, start, end)
+	}
+	wg.Wait()
+	stats.Duration = time.Since(start)
+	for _, err := range errs {
+		if err != nil {
+			return stats, err
+		}
+	}
+	pc.finish()
+	if err := f.Sync(); err != nil {
+		return stats, err
+	}
+	closed = true
+	if err := f.Close(); err != nil {
+		return stats, err
+	}
+	if md5 != "" {
+		if err := VerifyFileMD5(part, md5); err != nil {
+			os.Remove(part)
+			os.Remove(splitStatePath(path))
+			return stats, err
+		}
+		stats.Checksum = strings.ToLower(md5)
+	}
+	if err := os.Rename(part, path); err != nil {
+		return stats, err
+	}
+	os.Remove(splitStatePath(path))
+	return stats, SyncDir(filepath.Dir(path))
+}
+
+// fetchPart writes bytes [start, end) of the object to the same place in
+// f, returning their md5 once they're all written, and how many of them
+// were written either way.
+func fetchPart(ctx context.Context, link string, f *os.File, start, end int64, pc *progressCounter) (string, int64, error) {
+	h := md5.New()
+	ow := &offsetWriter{f: f, off: start}
+	if err := streamObjectRange(ctx, link, fmt.Sprintf("bytes=%d-%d", start, end-1), io.MultiWriter(ow, h, pc)); err != nil {
+		return "", ow.off - start, err
+	}
+	if ow.off != end {
+		return "", ow.off - start, errors.Errorf("got %d bytes of %d-%d", ow.off-start, start, end-1)
+	}
+	return hex.EncodeToString(h.Sum(nil)), end - start, nil
+}
+
+// sectionMD5 is the md5 of bytes [start, end) of f.
+func sectionMD5(f *os.File, start, end int64) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, end-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// offsetWriter writes sequentially into f from off.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// loadSplitState returns the saved progress for path, or nil if there is
+// none that fits a download of size bytes in parts of partSize.
+func loadSplitState(path string, size, partSize int64) *splitState {
+	data, err := ioutil.ReadFile(splitStatePath(path))
+	if err != nil {
+		return nil
+	}
+	var s splitState
+	if err := json.Unmarshal(data, &s); err != nil {
+		twig.Debugf("ignoring unreadable progress of %s: %s", path, err)
+		return nil
+	}
+	if s.Size != size || s.PartSize != partSize || int64(len(s.Done))*partSize < size {
+		twig.Debugf("progress of %s was saved for a different split, starting over", path)
+		return nil
+	}
+	return &s
+}
+
+// saveSplitState replaces the progress file in one step, so a crash never
+// leaves it half written.
+func saveSplitState(path string, s *splitState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := splitStatePath(path) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, splitStatePath(path))
+}
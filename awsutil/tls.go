@@ -0,0 +1,58 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// tlsConfig is what every transport from NewTransport verifies servers
+// with, nil for the system's roots.
+var tlsConfig *tls.Config
+
+// NewTLSConfig trusts the PEM certificates in the file at caCert on top
+// of the system's own roots, for a proxy or mirror that signs with a
+// private CA. With insecure, servers aren't verified at all, which is
+// only ever meant for testing.
+func NewTLSConfig(caCert string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read ca-cert %s", caCert)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			twig.Debugf("couldn't load the system's certificates, only trusting %s: %s", caCert, err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no PEM certificates in ca-cert %s", caCert)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// SetTLSConfig has every request for data and ngc files made from now on
+// verify servers with cfg.
+func SetTLSConfig(cfg *tls.Config) {
+	tlsConfig = cfg
+	DefaultClient.HTTP = NewClient().HTTP
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awsutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// ErrChecksumMismatch is returned when data doesn't match the md5 it was
+// expected to have.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Makes a ranged http GET request like GetObjectRange, additionally
+// checking the body against an md5 of exactly the bytes sent, if the
+// server provides one. The check happens as the body is read: the read
+// that reaches the end returns ErrChecksumMismatch when they differ.
+// verified reports whether the server gave such a checksum. Most object
+// stores only publish checksums of whole objects, so a range usually
+// can't be verified on its own and has to be checked as part of the file.
+func GetObjectRangeVerified(url, byteRange string) (resp *http.Response, verified bool, err error) {
+	resp, err = GetObjectRange(url, byteRange)
+	if err != nil {
+		return nil, false, err
+	}
+	want, ok := bodyMD5(resp)
+	if !ok {
+		twig.Debug("server gave no checksum for the range")
+		return resp, false, nil
+	}
+	resp.Body = &verifyingReader{ReadCloser: resp.Body, hash: md5.New(), want: want}
+	return resp, true, nil
+}
+
+// RangeChecksumSupported asks for the first byte of the object to find out
+// whether its server checksums ranges, so callers can decide up front
+// whether parts of it can be verified individually.
+func RangeChecksumSupported(url string) (bool, error) {
+	resp, verified, err := GetObjectRangeVerified(url, "bytes=0-0")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return verified && resp.StatusCode == http.StatusPartialContent, nil
+}
+
+// bodyMD5 finds an md5 in the response headers that covers the body as sent.
+func bodyMD5(resp *http.Response) ([]byte, bool) {
+	if v := resp.Header.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err == nil && len(sum) == md5.Size {
+			return sum, true
+		}
+	}
+	// Google reports the hash of the whole object, which only
+	// describes the body when the whole object was sent.
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	for _, v := range resp.Header["X-Goog-Hash"] {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if !strings.HasPrefix(part, "md5=") {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(part[len("md5="):])
+			if err == nil && len(sum) == md5.Size {
+				return sum, true
+			}
+		}
+	}
+	return nil, false
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.want) {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// FileMD5 returns the hex encoded md5 of the file at path.
+func FileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyFileMD5 checks the file at path against the hex encoded md5
+// want, such as the Md5Hash the Name Resolver API gives for a file.
+func VerifyFileMD5(path, want string) error {
+	got, err := FileMD5(path)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't checksum %s", path)
+	}
+	if !strings.EqualFold(got, want) {
+		return errors.Wrapf(ErrChecksumMismatch, "%s: expected md5 %s, got %s", path, want, got)
+	}
+	return nil
+}
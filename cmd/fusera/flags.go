@@ -30,6 +30,8 @@ import (
 
 	"github.com/mattrbianchi/twig"
 	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/jsonlog"
+	"github.com/mitre/fusera/nr"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -114,6 +116,12 @@ func NewApp() (app *cli.App, cmd *Commands) {
 				Action: func(c *cli.Context) error {
 					cmd.IsMount = true
 					twig.SetDebug(c.IsSet("debug"))
+					if err := jsonlog.SetFormat(c.String("log-format"), os.Stderr); err != nil {
+						return err
+					}
+					if err := jsonlog.SetVerbosity(c.Bool("quiet"), c.Bool("verbose"), c.Bool("vv") || c.Bool("debug")); err != nil {
+						return err
+					}
 					// Populate and parse flags.
 					flags, err := PopulateMountFlags(c)
 					if err != nil {
@@ -130,16 +138,31 @@ func NewApp() (app *cli.App, cmd *Commands) {
 						time.Sleep(time.Second)
 						flags.Cleanup()
 					}()
-					twig.Debugf("accs: %s", flags.Acc)
+					twig.Debugf("accs: %v", flags.Acc)
 					cmd.Flags = flags
 					return nil
 				},
 				Flags: []cli.Flag{
 					cli.StringFlag{
 						Name:   "ngc",
-						Usage:  "path to file that authenticates access",
+						Usage:  "path to file that authenticates access, or - to read it from stdin",
 						EnvVar: "DBGAP_CREDENTIALS",
 					},
+					cli.StringFlag{
+						Name:   "ngc-credentials",
+						Usage:  "comma separated list of aws credential sources to try in order when reading an ngc file from s3: default, env, profile:[name], or role:[arn]",
+						EnvVar: "FUSERA_NGC_CREDENTIALS",
+					},
+					cli.StringFlag{
+						Name:   "role-arn",
+						Usage:  "arn of an IAM role to assume for reading an ngc file from s3, using the usual aws credentials to assume it. The same as --ngc-credentials role:[arn], which it can't be used with",
+						EnvVar: "FUSERA_ROLE_ARN",
+					},
+					cli.StringFlag{
+						Name:   "ngc-region",
+						Usage:  "region of the s3 bucket holding the ngc file, such as us-gov-west-1, for when its url doesn't give it or gives the wrong one",
+						EnvVar: "FUSERA_NGC_REGION",
+					},
 					cli.StringFlag{
 						Name:   "acc",
 						Usage:  "comma separated list of accessions",
@@ -147,23 +170,122 @@ func NewApp() (app *cli.App, cmd *Commands) {
 					},
 					cli.StringFlag{
 						Name:   "acc-file",
-						Usage:  "path to a cart file, listing accession numbers",
+						Usage:  "path to a cart file, listing accession numbers, or a Run Selector SraRunTable.csv",
 						EnvVar: "DBGAP_ACCFILE",
 					},
+					cli.StringFlag{
+						Name:   "allow-prefixes",
+						Usage:  "comma separated list of accession prefixes, such as SRR,ERR. When set, any other accession is refused before anything is resolved.",
+						EnvVar: "FUSERA_ALLOW_PREFIXES",
+					},
 					cli.StringFlag{
 						Name:   "loc",
-						Usage:  "preferred region",
+						Usage:  "preferred region, looked up in instance metadata on amazon or google when left off",
 						EnvVar: "DBGAP_LOC",
 					},
+					cli.StringFlag{
+						Name:   "service",
+						Usage:  "comma separated list of services, like s3 or gs, whose link to use for a file the API gives more than one for, most preferred first",
+						EnvVar: "FUSERA_SERVICE",
+					},
 					cli.BoolFlag{
 						Name:   "debug",
 						Usage:  "Enable debugging output.",
 						EnvVar: "FUSERA_DEBUG",
 					},
+					cli.BoolFlag{
+						Name:   "quiet, q",
+						Usage:  "log nothing but errors",
+						EnvVar: "FUSERA_QUIET",
+					},
+					cli.BoolFlag{
+						Name:  "verbose, v",
+						Usage: "log fusera's info messages, as it does by default, or with -vv its debugging output as well",
+					},
+					cli.BoolFlag{
+						Name:  "vv",
+						Usage: "log at the most detail, the same as --debug",
+					},
+					cli.StringFlag{
+						Name:   "log-format",
+						Value:  "text",
+						Usage:  "format of the log: text, or json for a JSON object per line",
+						EnvVar: "FUSERA_LOG_FORMAT",
+					},
 					cli.StringFlag{
 						Name:   "endpoint",
-						Usage:  "Change the endpoint fusera uses to communicate with NIH API. Only to be used for advanced purposes.",
-						EnvVar: "DBGAP_ENDPOINT",
+						Usage:  "Change the endpoint fusera uses to communicate with NIH API, such as to try a staging one. Only to be used for advanced purposes.",
+						EnvVar: "FUSERA_NR_ENDPOINT,DBGAP_ENDPOINT",
+					},
+					cli.StringFlag{
+						Name:   "ca-cert",
+						Usage:  "path to a PEM bundle of CA certificates to trust, along with the system's, for the Name Resolver API and for data, such as behind a TLS-intercepting proxy",
+						EnvVar: "FUSERA_CA_CERT",
+					},
+					cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "don't verify the certificates of any server, for testing only",
+					},
+					cli.StringFlag{
+						Name:   "nr-version",
+						Value:  nr.DefaultVersion,
+						Usage:  "protocol version sent to the Name Resolver API, for trying a newer one before fusera knows about it",
+						EnvVar: "FUSERA_NR_VERSION",
+						Hidden: true,
+					},
+					cli.StringFlag{
+						Name:   "nr-pin",
+						Usage:  "comma separated list of certificate pins, base64 sha256 public keys or hex sha256 fingerprints. When set, the API's certificate chain must match one of them.",
+						EnvVar: "FUSERA_NR_PIN",
+					},
+					cli.DurationFlag{
+						Name:  "wait-for-endpoint",
+						Usage: "keep checking for up to this long (e.g. 2m) for the API to become reachable before giving up. Off by default.",
+					},
+					cli.IntFlag{
+						Name:  "max-redirects",
+						Value: awsutil.MaxRedirects,
+						Usage: "how many redirects to follow when reading a file, 0 to treat any redirect as an error.",
+					},
+					cli.IntFlag{
+						Name:  "data-retries",
+						Value: awsutil.MaxRetries,
+						Usage: "how many more times a read is tried after a 5xx or 429 response or a network error, before it fails.",
+					},
+					cli.DurationFlag{
+						Name:  "data-max-backoff",
+						Value: awsutil.MaxBackoff,
+						Usage: "longest to wait between retries of a read, 0 to retry without waiting.",
+					},
+					cli.IntFlag{
+						Name:  "connections-per-file",
+						Value: 1,
+						Usage: "how many ranged reads each open file may have in flight, fetching ahead of where it's read. Helps tools that read scattered parts of files, like BAM slicing.",
+					},
+					cli.IntFlag{
+						Name:  "max-connections",
+						Value: 64,
+						Usage: "bound on the ranged reads in flight across all open files when connections-per-file is above 1, 0 for no bound.",
+					},
+					cli.IntFlag{
+						Name:  "max-conns-per-host",
+						Value: awsutil.MaxConnsPerHost,
+						Usage: "cap on the connections to any single host serving data, 0 for none",
+					},
+					cli.IntFlag{
+						Name:  "resolve-retries",
+						Value: nr.MaxRetries,
+						Usage: "times to retry a request to the Name Resolver API that failed with a network error or a 5xx or 429 response, with growing waits in between.",
+					},
+					cli.DurationFlag{
+						Name:  "refresh-margin",
+						Value: nr.RefreshMargin,
+						Usage: "resolve a file's url again when it expires within this long, rather than read from it.",
+					},
+					cli.StringFlag{
+						Name:   "cache-dir",
+						Usage:  "directory of resolved urls cached by sracp prewarm. When set, cached urls that haven't expired are used instead of asking the API again.",
+						EnvVar: "FUSERA_CACHE_DIR",
 					},
 				},
 			},
@@ -179,6 +301,12 @@ func NewApp() (app *cli.App, cmd *Commands) {
 					}
 					cmd.Path = c.Args().First()
 					twig.SetDebug(c.IsSet("debug"))
+					if err := jsonlog.SetFormat(c.String("log-format"), os.Stderr); err != nil {
+						return err
+					}
+					if err := jsonlog.SetVerbosity(c.Bool("quiet"), c.Bool("verbose"), c.Bool("vv") || c.Bool("debug")); err != nil {
+						return err
+					}
 					return nil
 				},
 				Flags: []cli.Flag{
@@ -187,6 +315,25 @@ func NewApp() (app *cli.App, cmd *Commands) {
 						Usage:  "Enable debugging output.",
 						EnvVar: "FUSERA_DEBUG",
 					},
+					cli.BoolFlag{
+						Name:   "quiet, q",
+						Usage:  "log nothing but errors",
+						EnvVar: "FUSERA_QUIET",
+					},
+					cli.BoolFlag{
+						Name:  "verbose, v",
+						Usage: "log fusera's info messages, as it does by default, or with -vv its debugging output as well",
+					},
+					cli.BoolFlag{
+						Name:  "vv",
+						Usage: "log at the most detail, the same as --debug",
+					},
+					cli.StringFlag{
+						Name:   "log-format",
+						Value:  "text",
+						Usage:  "format of the log: text, or json for a JSON object per line",
+						EnvVar: "FUSERA_LOG_FORMAT",
+					},
 				},
 			},
 		},
@@ -226,6 +373,11 @@ type Flags struct {
 
 	Debug    bool
 	Endpoint string
+	CacheDir string
+
+	WaitForEndpoint time.Duration
+
+	ConnectionsPerFile int
 }
 
 func (f *Flags) Cleanup() {
@@ -255,22 +407,80 @@ func PopulateMountFlags(c *cli.Context) (ret *Flags, err error) {
 		// Debugging,
 		Debug:    c.Bool("debug"),
 		Endpoint: c.String("endpoint"),
+		CacheDir: c.String("cache-dir"),
+
+		WaitForEndpoint: c.Duration("wait-for-endpoint"),
+
+		ConnectionsPerFile: c.Int("connections-per-file"),
+	}
+	if err := nr.CheckEndpoint(f.Endpoint); err != nil {
+		return nil, err
+	}
+	if f.ConnectionsPerFile < 1 {
+		return nil, errors.New("connections-per-file must be at least 1")
+	}
+	if c.Int("max-connections") < 0 {
+		return nil, errors.New("max-connections can't be negative")
+	}
+	awsutil.SetMaxConnections(c.Int("max-connections"))
+	if c.Int("max-conns-per-host") < 0 {
+		return nil, errors.New("max-conns-per-host can't be negative")
+	}
+	awsutil.SetMaxConnsPerHost(c.Int("max-conns-per-host"))
+	if c.Int("max-redirects") < 0 {
+		return nil, errors.New("max-redirects can't be negative")
+	}
+	awsutil.MaxRedirects = c.Int("max-redirects")
+	if c.Int("data-retries") < 0 {
+		return nil, errors.New("data-retries can't be negative")
+	}
+	awsutil.MaxRetries = c.Int("data-retries")
+	if c.Duration("data-max-backoff") < 0 {
+		return nil, errors.New("data-max-backoff can't be negative")
+	}
+	awsutil.MaxBackoff = c.Duration("data-max-backoff")
+	if c.Duration("refresh-margin") < 0 {
+		return nil, errors.New("refresh-margin can't be negative")
+	}
+	nr.RefreshMargin = c.Duration("refresh-margin")
+	if c.Int("resolve-retries") < 0 {
+		return nil, errors.New("resolve-retries can't be negative")
+	}
+	nr.MaxRetries = c.Int("resolve-retries")
+	if c.Bool("insecure") && c.String("nr-pin") != "" {
+		return nil, errors.New("nr-pin only checks a verified certificate chain, it can't be used with insecure")
+	}
+	if c.String("ca-cert") != "" || c.Bool("insecure") {
+		cfg, err := awsutil.NewTLSConfig(c.String("ca-cert"), c.Bool("insecure"))
+		if err != nil {
+			return nil, err
+		}
+		if cfg.InsecureSkipVerify {
+			twig.Info("WARNING: --insecure is set, no server's certificate will be verified")
+		}
+		awsutil.SetTLSConfig(cfg)
+		nr.SetTLSConfig(cfg)
+	}
+	nr.Version = strings.TrimSpace(c.String("nr-version"))
+	if nr.Version == "" {
+		return nil, errors.New("nr-version can't be empty")
+	}
+	if pins := c.String("nr-pin"); pins != "" {
+		if err := nr.PinCertificates(strings.Split(pins, ",")); err != nil {
+			return nil, err
+		}
 	}
 	ngcpath := c.String("ngc")
 	if ngcpath != "" {
-		// we were given a path to an ngc file. Let's read it.
-		var data []byte
-		if strings.HasPrefix(ngcpath, "http") {
-			// we were given a url on s3.
-			data, err = awsutil.ReadNgcFile(ngcpath)
-			if err != nil {
-				return nil, errors.Wrapf(err, "couldn't open ngc file at: %s", ngcpath)
-			}
-		} else {
-			data, err = ioutil.ReadFile(ngcpath)
-			if err != nil {
-				return nil, errors.Wrapf(err, "couldn't open ngc file at: %s", ngcpath)
-			}
+		// we were given a path to an ngc file, local or on s3 or google cloud storage, or - for stdin.
+		awsutil.NgcRegion = c.String("ngc-region")
+		sources, err := credentialSources(c)
+		if err != nil {
+			return nil, err
+		}
+		data, err := awsutil.ReadNgcFileWith(ngcpath, sources)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't open ngc file at: %s", ngcpath)
 		}
 		f.Ngc = data
 	}
@@ -293,7 +503,10 @@ func PopulateMountFlags(c *cli.Context) (ret *Flags, err error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "couldn't open acc file at: %s", accpath)
 		}
-		accs := reconcileAccs(data)
+		accs, err := nr.ParseAccessionList(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read acc file at: %s", accpath)
+		}
 		for _, a := range accs {
 			if a != "" {
 				f.Acc[a] = true
@@ -303,18 +516,19 @@ func PopulateMountFlags(c *cli.Context) (ret *Flags, err error) {
 	if len(aa) == 0 && accpath == "" {
 		return nil, errors.New("must provide at least one accession number")
 	}
+	if err := nr.CheckPrefixes(f.Acc, nr.ParsePrefixes(c.String("allow-prefixes"))); err != nil {
+		return nil, err
+	}
 	loc := c.String("loc")
 	if !c.IsSet("loc") {
-		loc, err = awsutil.ResolveRegion()
-		if err != nil {
-			return nil, err
-		}
+		// off the cloud there's none to find, and the API picks for itself
+		loc = awsutil.DetectLocation()
 	}
-	ok := awsutil.IsLocation(loc)
-	if !ok {
+	if loc != "" && !awsutil.IsLocation(loc) {
 		return nil, errors.Errorf("gave location of %s, location must match one of these possibilities:\n%s", loc, awsutil.IncorrectLocationMessage)
 	}
 	f.Loc = loc
+	nr.PreferredServices = nr.ParseServices(c.String("service"))
 
 	f.MountPointArg = c.Args().First()
 	f.MountPoint = f.MountPointArg
@@ -375,29 +589,16 @@ func MyUserAndGroup() (int, int) {
 	return int(uid64), int(gid64)
 }
 
-func reconcileAccs(data []byte) []string {
-	accs := strings.Split(string(data), ",")
-	if len(accs) != 1 {
-		return accs
-	}
-	accs = strings.Split(string(data), " ")
-	if len(accs) != 1 {
-		return accs
-	}
-	accs = strings.Split(string(data), "\n")
-	return vetAccs(accs)
-}
-
-func vetAccs(accs []string) []string {
-	aa := make([]string, 0, len(accs))
-	for _, a := range accs {
-		if !strings.Contains(a, "SRR") ||
-			strings.Contains(a, " ") ||
-			strings.Contains(a, ",") ||
-			strings.Contains(a, "\n") {
-			continue
+// credentialSources is the list of aws credential sources given by
+// ngc-credentials, or the single role of role-arn, which is the same as
+// giving role:[arn] and so can't be used along with it.
+func credentialSources(c *cli.Context) ([]awsutil.CredentialSource, error) {
+	spec := c.String("ngc-credentials")
+	if arn := c.String("role-arn"); arn != "" {
+		if spec != "" {
+			return nil, errors.New("role-arn is the same as ngc-credentials role:[arn], give only one of them")
 		}
-		aa = append(aa, a)
+		spec = "role:" + arn
 	}
-	return aa
+	return awsutil.ParseCredentialSources(spec)
 }
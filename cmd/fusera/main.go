@@ -27,13 +27,16 @@ import (
 
 	"github.com/mattrbianchi/twig"
 	"github.com/mitre/fusera"
+	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/jsonlog"
+	"github.com/mitre/fusera/nr"
 
 	"github.com/jacobsa/fuse"
 	"github.com/kardianos/osext"
 )
 
 func init() {
-	twig.SetFlags(twig.LstdFlags | twig.Lshortfile)
+	jsonlog.SetLevel(jsonlog.Info)
 }
 
 func registerSIGINTHandler(fs *fusera.Fusera, flags *Flags) {
@@ -86,6 +89,7 @@ func mount(ctx context.Context, flags *Flags) (*fusera.Fusera, *fuse.MountedFile
 		Ngc:               flags.Ngc,
 		Loc:               flags.Loc,
 		ApiEndpoint:       flags.Endpoint,
+		CacheDir:          flags.CacheDir,
 		MountOptions:      flags.MountOptions,
 		MountPoint:        flags.MountPoint,
 		MountPointArg:     flags.MountPointArg,
@@ -95,6 +99,8 @@ func mount(ctx context.Context, flags *Flags) (*fusera.Fusera, *fuse.MountedFile
 		Uid:               flags.Uid,
 		Gid:               flags.Gid,
 		Debug:             flags.Debug,
+
+		ConnectionsPerFile: flags.ConnectionsPerFile,
 	}
 	return fusera.Mount(ctx, opt)
 }
@@ -123,6 +129,8 @@ var Version = "beta"
 
 func main() {
 	VersionHash = Version
+	nr.UserAgent = "fusera/" + Version
+	awsutil.UserAgent = nr.UserAgent
 	massagePath()
 	app, cmd := NewApp()
 	err := app.Run(MassageMountFlags(os.Args))
@@ -132,6 +140,14 @@ func main() {
 		os.Exit(1)
 	}
 	if cmd.IsMount {
+		if cmd.Flags.WaitForEndpoint > 0 {
+			err = nr.WaitForEndpoint(cmd.Flags.Endpoint, cmd.Flags.WaitForEndpoint)
+			if err != nil {
+				fmt.Println("Fusera couldn't reach the API to find the accessions")
+				fmt.Println("Details: " + err.Error())
+				os.Exit(1)
+			}
+		}
 		// Mount the file system.
 		var mfs *fuse.MountedFileSystem
 		var fs *fusera.Fusera
@@ -154,6 +170,7 @@ func main() {
 
 		// Wait for the file system to be unmounted.
 		err = mfs.Join(context.Background())
+		nr.WipeNgc(cmd.Flags.Ngc)
 		if err != nil {
 			fmt.Println("fusera encountered an internal issue, please rerun with the --debug flag to learn more.")
 			twig.Debugf("FATAL: MountedFileSystem.Join: %+#v\n", err)
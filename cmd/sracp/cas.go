@@ -0,0 +1,141 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+// casLayout stores files under <root>/cas/ab/cd/abcd... by their md5, and
+// gives each accession a directory of symlinks into the store, so a file
+// shared by many accessions is only downloaded and stored once. Files the
+// API gives no md5 for are stored in the accession's directory as usual.
+type casLayout struct {
+	root string
+	// jobs already planned in this run, by store path
+	jobs map[string]*job
+}
+
+// A casLink is one accession's file that's linked to a stored file.
+type casLink struct {
+	acc  string
+	file string
+	path string
+}
+
+func newCASLayout(root string) *casLayout {
+	return &casLayout{root: root, jobs: make(map[string]*job)}
+}
+
+func (l *casLayout) path(md5 string) string {
+	return filepath.Join(l.root, "cas", md5[0:2], md5[2:4], md5)
+}
+
+func validMD5(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// plan works out how the file f of acc, which belongs at link, gets there.
+// It returns the job needed to download it, or nil if nothing needs
+// downloading: the file is already in the store, or another job of this
+// run is already bringing it in.
+func (l *casLayout) plan(acc string, f nr.File, link string) (*job, error) {
+	if !validMD5(f.Md5Hash) {
+		return newJob(acc, f, link), nil
+	}
+	md5 := strings.ToLower(f.Md5Hash)
+	stored := l.path(md5)
+	if j, ok := l.jobs[stored]; ok {
+		j.links = append(j.links, casLink{acc: acc, file: f.Name, path: link})
+		return nil, nil
+	}
+	if _, err := os.Stat(stored); err == nil {
+		twig.Debugf("%s is already stored as %s", link, stored)
+		return nil, symlink(stored, link)
+	}
+	if err := os.MkdirAll(filepath.Dir(stored), 0755); err != nil {
+		return nil, errors.Wrap(err, "couldn't create directory in content addressable store")
+	}
+	// Only content that checked out is ever put at its md5 path, so
+	// whatever is found in the store can be trusted.
+	j := newJob(acc, f, stored+".part")
+	j.final = stored
+	j.links = []casLink{{acc: acc, file: f.Name, path: link}}
+	l.jobs[stored] = j
+	return j, nil
+}
+
+// commit verifies a finished job's download and moves it into the store,
+// then links every accession that wanted it.
+func (l *casLayout) commit(j *job) error {
+	if j.final == "" {
+		return nil
+	}
+	if j.verify(); j.err != nil {
+		return j.err
+	}
+	if err := os.Rename(j.path, j.final); err != nil {
+		return errors.Wrap(err, "couldn't move download into content addressable store")
+	}
+	for _, link := range j.links {
+		if err := symlink(j.final, link.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failures is what a job that failed with err is reported as: one
+// failure for each accession that was to be linked to it, or just its
+// own for a job that isn't going into the store.
+func (j *job) failures(err error) []failure {
+	if len(j.links) == 0 {
+		return []failure{{Acc: j.acc, File: j.file.Name, Reason: err.Error()}}
+	}
+	fs := make([]failure, 0, len(j.links))
+	for _, link := range j.links {
+		fs = append(fs, failure{Acc: link.acc, File: link.file, Reason: err.Error()})
+	}
+	return fs
+}
+
+// symlink makes link point at target with a relative path, so the whole
+// tree can be moved, replacing any symlink already there.
+func symlink(target, link string) error {
+	rel, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(link); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return errors.Errorf("couldn't link %s, a file is already there", link)
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(rel, link)
+}
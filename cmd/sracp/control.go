@@ -0,0 +1,241 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// control lets an operator steer a long running copy from outside of it.
+// While paused, no new downloads start but those in flight finish, so
+// bandwidth can be given back without losing progress. A copy is paused
+// by SIGUSR1, resumed by SIGUSR2, and is also paused whenever the pause
+// file exists. SIGINT or SIGTERM stop it by cancelling ctx, which every
+// download and request is made under, failing the downloads in flight and
+// those yet to start and removing what the unfinished ones had written
+// unless keepPartial is set. ctx also runs out once the run's --timeout
+// has passed.
+type control struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	timeout     time.Duration
+	pauseFile   string
+	keepPartial bool
+
+	mu       sync.Mutex
+	signaled bool
+	stopped  os.Signal
+	total    int
+	done     int
+	active   map[*job]bool
+}
+
+func newControl(ctx context.Context, timeout time.Duration, pauseFile string, keepPartial bool) *control {
+	ctx, cancel := context.WithCancel(ctx)
+	return &control{ctx: ctx, cancel: cancel, timeout: timeout, pauseFile: pauseFile, keepPartial: keepPartial, active: make(map[*job]bool)}
+}
+
+// runContext is the root context of a run, bounded by timeout unless it's
+// zero.
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func (c *control) watchSignals() {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		c.interrupted(<-stopChan)
+		// stopping can take a moment, a second signal doesn't wait for it
+		s := <-stopChan
+		twig.Infof("Received %s again, exiting without cleaning up\n", s)
+		os.Exit(1)
+	}()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range signalChan {
+			c.mu.Lock()
+			c.signaled = s == syscall.SIGUSR1
+			c.mu.Unlock()
+			if s == syscall.SIGUSR1 {
+				twig.Info("Received SIGUSR1, pausing new downloads until SIGUSR2")
+			} else {
+				twig.Info("Received SIGUSR2, resuming downloads")
+			}
+		}
+	}()
+}
+
+func (c *control) paused() bool {
+	c.mu.Lock()
+	signaled := c.signaled
+	c.mu.Unlock()
+	if signaled {
+		return true
+	}
+	if c.pauseFile == "" {
+		return false
+	}
+	_, err := os.Stat(c.pauseFile)
+	return err == nil
+}
+
+// wait blocks for as long as the copy is paused, or until the run is out
+// of time or stopped.
+func (c *control) wait() {
+	if !c.paused() {
+		return
+	}
+	twig.Info("Paused, waiting to start the next download")
+	for c.paused() && c.ctx.Err() == nil {
+		time.Sleep(time.Second)
+	}
+	twig.Info("Resumed")
+}
+
+func (c *control) start(total int) {
+	c.mu.Lock()
+	c.total = total
+	c.mu.Unlock()
+}
+
+// begin marks j as being downloaded, unless the run is already out of
+// time or stopped, when j fails without being started and begin returns
+// false.
+func (c *control) begin(j *job) bool {
+	if c.ctx.Err() != nil {
+		j.err = c.stopError()
+		return false
+	}
+	c.mu.Lock()
+	c.active[j] = true
+	c.mu.Unlock()
+	return true
+}
+
+func (c *control) timeoutError() error {
+	return errors.Errorf("timed out, the run's --timeout of %s ran out", c.timeout)
+}
+
+// stopError is why a job didn't finish once the run's ctx is done.
+func (c *control) stopError() error {
+	if s := c.signal(); s != nil {
+		return errors.Errorf("stopped by %s before it finished", s)
+	}
+	return c.timeoutError()
+}
+
+// signal is the signal the run was stopped by, nil while it hasn't been.
+func (c *control) signal() os.Signal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped
+}
+
+// fileContext bounds the download of a single file by timeout, when it
+// isn't zero, as well as by the run's deadline.
+func (c *control) fileContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithTimeout(c.ctx, timeout)
+}
+
+// timedOut fails j when ctx, the context its download ran under, ran out
+// before it finished. When it was the run that ran out of time what
+// arrived is left for the next run to resume, while a file that went past
+// its own --file-timeout of timeout is removed, since a retry would start
+// over anyway. A download the run was stopped partway through is failed
+// too, with what it wrote removed unless keepPartial is set.
+func (c *control) timedOut(j *job, ctx context.Context, timeout time.Duration) {
+	if ctx.Err() == context.Canceled && j.err != nil {
+		if s := c.signal(); s != nil {
+			if !c.keepPartial {
+				j.removePartial()
+			}
+			j.err = c.stopError()
+		}
+		return
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	if c.ctx.Err() != nil {
+		j.err = c.timeoutError()
+		return
+	}
+	j.removePartial()
+	j.err = errors.Errorf("download didn't finish within the --file-timeout of %s", timeout)
+}
+
+func (c *control) finished(j *job) {
+	c.mu.Lock()
+	c.done++
+	delete(c.active, j)
+	c.mu.Unlock()
+}
+
+// interrupted stops the run by cancelling its ctx. The downloads in
+// flight return and are failed by timedOut, and the run reports them
+// along with the ones that never started. Files already given their real
+// names were complete and checked, so they stay.
+func (c *control) interrupted(s os.Signal) {
+	c.mu.Lock()
+	c.stopped = s
+	if c.keepPartial {
+		twig.Infof("Received %s, stopping with %d of %d files done, leaving %d unfinished downloads to resume\n", s, c.done, c.total, len(c.active))
+	} else {
+		twig.Infof("Received %s, stopping with %d of %d files done, removing %d unfinished downloads\n", s, c.done, c.total, len(c.active))
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+// heartbeat logs how far along the copy is every interval until stop is
+// called. An interval of zero means no heartbeats.
+func (c *control) heartbeat(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.mu.Lock()
+				finished, total := c.done, c.total
+				c.mu.Unlock()
+				twig.Infof("heartbeat: %d of %d files done, paused=%t\n", finished, total, c.paused())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+// parseExpectedCounts reads a line per accession of the accession and the
+// number of files it should have, separated by a comma or whitespace.
+// Blank lines and lines starting with # are skipped.
+func parseExpectedCounts(data []byte) (map[string]int, error) {
+	counts := make(map[string]int)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return nil, errors.Errorf("line %d: expected an accession and a file count, got: %s", line, text)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("line %d: invalid file count for %s: %s", line, fields[0], fields[1])
+		}
+		counts[fields[0]] = n
+	}
+	return counts, s.Err()
+}
+
+// checkFileCounts returns the accessions that came back with a different
+// number of files than expected, each with a description of how.
+// An accession with no count of its own is held to flags.ExpectFiles,
+// and isn't checked at all when that's 0.
+func checkFileCounts(flags *Flags, accs map[string]nr.Accession) []failure {
+	var off []failure
+	for id, a := range accs {
+		want, ok := flags.ExpectFilesFor[id]
+		if !ok {
+			want = flags.ExpectFiles
+		}
+		if want == 0 {
+			continue
+		}
+		if got := len(a.Files); got != want {
+			off = append(off, failure{Acc: id, Reason: fmt.Sprintf("expected %d files, the API returned %d", want, got)})
+		}
+	}
+	sort.Slice(off, func(i, j int) bool { return off[i].Acc < off[j].Acc })
+	return off
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+const crateName = "ro-crate-metadata.json"
+
+// wantedFile is a file a run set out to copy, wherever it actually ends up
+// being stored.
+type wantedFile struct {
+	acc  string
+	file nr.File
+	path string
+}
+
+// entity is one node of an RO-Crate's JSON-LD graph.
+type entity map[string]interface{}
+
+func ref(id string) entity {
+	return entity{"@id": id}
+}
+
+// writeROCrate describes the files that made it into dir as an RO-Crate
+// (https://w3id.org/ro/crate/1.1), so the download can be archived and
+// shared as a self describing package: each file with its checksum, size
+// and where it came from, and how it was resolved and by what.
+func writeROCrate(dir string, wanted []wantedFile, failures []failure, resolved, finished time.Time) error {
+	failed := make(map[string]bool)
+	for _, f := range failures {
+		failed[f.Acc+"/"+f.File] = true
+		if f.File == "" {
+			failed[f.Acc+"/"] = true
+		}
+	}
+	sort.Slice(wanted, func(i, j int) bool { return wanted[i].path < wanted[j].path })
+
+	var parts, results []entity
+	accessions := make(map[string]bool)
+	graph := []entity{
+		{
+			"@id":        crateName,
+			"@type":      "CreativeWork",
+			"conformsTo": ref("https://w3id.org/ro/crate/1.1"),
+			"about":      ref("./"),
+		},
+	}
+	for _, w := range wanted {
+		if failed[w.acc+"/"+w.file.Name] || failed[w.acc+"/"] {
+			continue
+		}
+		// follows the symlinks of a content addressed layout
+		fi, err := os.Stat(w.path)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, w.path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		file := entity{
+			"@id":          rel,
+			"@type":        "File",
+			"name":         w.file.Name,
+			"contentSize":  fi.Size(),
+			"contentUrl":   awsutil.RedactURL(w.file.Link),
+			"isPartOf":     ref("#" + w.acc),
+			"dateModified": w.file.ModifiedDate.UTC().Format(time.RFC3339),
+		}
+		if w.file.Md5Hash != "" {
+			file["md5"] = w.file.Md5Hash
+		}
+		graph = append(graph, file)
+		parts = append(parts, ref(rel))
+		results = append(results, ref(rel))
+		accessions[w.acc] = true
+	}
+	ids := make([]string, 0, len(accessions))
+	for a := range accessions {
+		ids = append(ids, a)
+	}
+	sort.Strings(ids)
+	var objects []entity
+	for _, a := range ids {
+		graph = append(graph, entity{
+			"@id":        "#" + a,
+			"@type":      "Dataset",
+			"identifier": a,
+			"name":       a,
+			"url":        "https://www.ncbi.nlm.nih.gov/sra/" + a,
+		})
+		objects = append(objects, ref("#"+a))
+	}
+	graph = append(graph,
+		entity{
+			"@id":           "./",
+			"@type":         "Dataset",
+			"name":          "SRA accessions copied by sracp",
+			"datePublished": finished.UTC().Format(time.RFC3339),
+			"hasPart":       parts,
+			"mentions":      ref("#resolution"),
+		},
+		entity{
+			"@id":        "#resolution",
+			"@type":      "CreateAction",
+			"name":       "Resolved with the NCBI Name Resolver API and copied",
+			"instrument": ref("#sracp"),
+			"startTime":  resolved.UTC().Format(time.RFC3339),
+			"endTime":    finished.UTC().Format(time.RFC3339),
+			"object":     objects,
+			"result":     results,
+		},
+		entity{
+			"@id":     "#sracp",
+			"@type":   "SoftwareApplication",
+			"name":    "sracp",
+			"url":     "https://github.com/mitre/fusera",
+			"version": Version,
+		},
+	)
+	data, err := json.MarshalIndent(entity{
+		"@context": "https://w3id.org/ro/crate/1.1/context",
+		"@graph":   graph,
+	}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode ro-crate metadata")
+	}
+	path := filepath.Join(dir, crateName)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// diffManifests writes every difference between the files copied
+// according to manifests a and b to w: accessions and files only in one
+// of them, marked - when only in a and + when only in b, and files in both
+// whose size or md5 disagree, marked ~. Files a manifest records as not
+// copied count as missing from it. It returns whether there were any.
+func diffManifests(w io.Writer, a, b *manifest) bool {
+	af, aa := indexManifest(a)
+	bf, ba := indexManifest(b)
+	differ := false
+	for _, acc := range onlyIn(aa, ba) {
+		fmt.Fprintf(w, "- accession %s\n", acc)
+		differ = true
+	}
+	for _, acc := range onlyIn(ba, aa) {
+		fmt.Fprintf(w, "+ accession %s\n", acc)
+		differ = true
+	}
+	for _, key := range onlyIn(af, bf) {
+		fmt.Fprintf(w, "- file %s\n", key)
+		differ = true
+	}
+	for _, key := range onlyIn(bf, af) {
+		fmt.Fprintf(w, "+ file %s\n", key)
+		differ = true
+	}
+	for _, key := range sortedKeys(af) {
+		ea := af[key]
+		eb, ok := bf[key]
+		if !ok {
+			continue
+		}
+		if ea.Size != eb.Size {
+			fmt.Fprintf(w, "~ %s size %d -> %d\n", key, ea.Size, eb.Size)
+			differ = true
+		}
+		if !strings.EqualFold(ea.Md5, eb.Md5) {
+			fmt.Fprintf(w, "~ %s md5 %s -> %s\n", key, orNone(ea.Md5), orNone(eb.Md5))
+			differ = true
+		}
+	}
+	return differ
+}
+
+// indexManifest returns the copied files of m by accession/file, along with the
+// accessions they belong to.
+func indexManifest(m *manifest) (map[string]manifestEntry, map[string]manifestEntry) {
+	files := make(map[string]manifestEntry)
+	accs := make(map[string]manifestEntry)
+	for _, e := range m.Files {
+		if !e.copied() {
+			continue
+		}
+		files[e.Acc+"/"+e.File] = e
+		accs[e.Acc] = e
+	}
+	return files, accs
+}
+
+// onlyIn returns the sorted keys of x that aren't in y.
+func onlyIn(x, y map[string]manifestEntry) []string {
+	var keys []string
+	for k := range x {
+		if _, ok := y[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]manifestEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
@@ -0,0 +1,537 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+// job is a single file of an accession that is to be copied to path.
+type job struct {
+	acc  string
+	file nr.File
+	path string
+	err  error
+
+	// when the file is downloaded somewhere other than where it finally
+	// belongs, it's moved to final and then linked from each of links
+	final string
+	links []casLink
+
+	// whether path is an s3:// url of --dest rather than a file on disk,
+	// which the uploader sized and checked as it went
+	remote bool
+
+	// where the file came from and how much of it arrived
+	host   string
+	region string
+	bytes  int64
+
+	// whether the downloader already checked the md5 as it went, and the
+	// md5 it worked out, when it did
+	verified bool
+	md5      string
+
+	// what the native downloaders measured, zero for the others
+	stats awsutil.TransferStats
+}
+
+func newJob(acc string, f nr.File, path string) *job {
+	return &job{
+		acc:    acc,
+		file:   f,
+		path:   path,
+		host:   awsutil.Host(f.Link),
+		region: awsutil.InferRegion(f.Service, f.Link),
+	}
+}
+
+// record adds the stats of one attempt at j, which may be after a refused
+// one, keeping the checksum of the last.
+func (j *job) record(s awsutil.TransferStats) {
+	j.stats.BytesWritten += s.BytesWritten
+	j.stats.Duration += s.Duration
+	j.stats.Retries += s.Retries
+	j.stats.Checksum = s.Checksum
+	j.md5 = s.Checksum
+}
+
+// finish records how many bytes ended up at the job's path, for
+// downloaders that don't count them as they go.
+func (j *job) finish() {
+	if j.err != nil || j.bytes != 0 || j.remote {
+		return
+	}
+	if fi, err := os.Stat(j.path); err == nil {
+		j.bytes = fi.Size()
+	}
+}
+
+// verify checks a downloaded file against the md5 the API gave for it,
+// unless the downloader already did, removing it when they differ.
+func (j *job) verify() {
+	if j.err != nil || j.verified || j.file.Md5Hash == "" || j.remote {
+		return
+	}
+	if j.md5 != "" {
+		if !strings.EqualFold(j.md5, j.file.Md5Hash) {
+			j.err = errors.Wrapf(awsutil.ErrChecksumMismatch, "%s: expected md5 %s, got %s", j.path, j.file.Md5Hash, j.md5)
+		}
+	} else {
+		j.err = awsutil.VerifyFileMD5(j.path, j.file.Md5Hash)
+	}
+	if j.err != nil {
+		os.Remove(j.path)
+	}
+	j.verified = j.err == nil
+}
+
+// removePartial removes whatever an unfinished download of j has left:
+// the .part file and split progress of the native and curl downloaders,
+// an aria2c download along with its control file, and for a job headed
+// into the store the download itself, which is only complete once it's
+// been committed. An upload to --dest leaves nothing on disk, and nothing
+// in the bucket unless it finished.
+func (j *job) removePartial() {
+	if j.remote {
+		return
+	}
+	os.Remove(j.path + ".part")
+	os.Remove(j.path + ".parts")
+	if _, err := os.Stat(j.path + ".aria2"); err == nil {
+		os.Remove(j.path)
+		os.Remove(j.path + ".aria2")
+	}
+	if j.final != "" {
+		os.Remove(j.path)
+	}
+}
+
+// alreadyCopied reports whether path already holds f, as checkCopy sees
+// it. A file that can't be checked either way is copied again, as is one
+// aria2c didn't finish.
+func alreadyCopied(f nr.File, path string, checksum bool) bool {
+	checked, err := checkCopy(f, path, checksum)
+	return err == nil && checked
+}
+
+// copiedBefore is alreadyCopied for wherever flags copies to. An object
+// already in the bucket is only gone by its size, reading it back to check
+// its md5 would cost as much as copying it again.
+func copiedBefore(flags *Flags, acc string, f nr.File, path string) bool {
+	if flags.Dest == nil {
+		return alreadyCopied(f, path, !flags.SkipChecksum)
+	}
+	size, err := f.ParsedSize()
+	return err == nil && flags.Dest.Has(flags.Dest.Key(acc, f.Name), size)
+}
+
+// A downloader copies the files described by jobs to their paths,
+// recording any failure on the job itself.
+type downloader interface {
+	download(jobs []*job)
+}
+
+// renewer swaps in a fresh link for a job whose link would expire too
+// soon to be used, resolving its accession again.
+type renewer struct {
+	flags *Flags
+	ctx   context.Context
+}
+
+func (r renewer) renew(j *job) {
+	if !nr.NeedsRefresh(j.file.ExpirationDate) {
+		return
+	}
+	twig.Debugf("link for %s expires soon: %s, resolving it again", j.path, j.file.ExpirationDate)
+	f, err := r.resolve(j.acc, j.file.Name)
+	if err != nil {
+		// carry on with the old link, it may last long enough
+		twig.Debugf("couldn't renew link for %s: %s", j.path, err)
+		return
+	}
+	j.file = f
+	j.host = awsutil.Host(f.Link)
+	j.region = awsutil.InferRegion(f.Service, f.Link)
+}
+
+// resolve asks the API about a single file of an accession again.
+func (r renewer) resolve(acc, name string) (nr.File, error) {
+	client := nr.NewClient(nr.WithEndpoint(r.flags.Endpoint), nr.WithLocation(r.flags.Loc), nr.WithNgc(r.flags.Ngc))
+	a, err := client.ResolveOneContext(r.ctx, acc)
+	if err != nil {
+		return nr.File{}, err
+	}
+	f, ok := a.Files[name]
+	if !ok || f.Link == "" {
+		return nr.File{}, errors.Errorf("API gave no new link for %s/%s", acc, name)
+	}
+	return f, nil
+}
+
+// client renews a link once it's refused partway through a download.
+func (r renewer) client() *awsutil.Client {
+	return &awsutil.Client{Renew: func(acc, name string) (string, error) {
+		f, err := r.resolve(acc, name)
+		return f.Link, err
+	}}
+}
+
+// parallel runs fn on each of jobs, n at a time. Each job is only ever
+// handled by one goroutine, so fn can record its outcome on the job.
+func parallel(jobs []*job, n int, fn func(*job)) {
+	queue := make(chan *job)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				fn(j)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func newDownloader(flags *Flags, ctl *control) (downloader, error) {
+	r := renewer{flags: flags, ctx: ctl.ctx}
+	if flags.Dest != nil {
+		return s3Downloader{
+			dest:     flags.Dest,
+			ctl:      ctl,
+			renewer:  r,
+			parallel: flags.Parallel,
+			verify:   !flags.SkipChecksum,
+			progress: flags.Progress,
+			timeout:  flags.FileTimeout,
+		}, nil
+	}
+	switch flags.Downloader {
+	case "native":
+		return nativeDownloader{
+			ctl:      ctl,
+			renewer:  r,
+			parallel: flags.Parallel,
+			parts:    flags.FileParallel,
+			verify:   !flags.SkipChecksum,
+			progress: flags.Progress,
+			timeout:  flags.FileTimeout,
+		}, nil
+	case "curl":
+		if _, err := exec.LookPath("curl"); err != nil {
+			return nil, errors.Wrap(err, "the curl downloader requires curl to be installed")
+		}
+		d := curlDownloader{ctl: ctl, renewer: r, parallel: flags.Parallel, verify: !flags.SkipChecksum, timeout: flags.FileTimeout}
+		if flags.MaxRate > 0 {
+			// each curl only knows about itself
+			d.rate = flags.MaxRate / int64(flags.Parallel)
+			if d.rate < 1 {
+				d.rate = 1
+			}
+		}
+		return d, nil
+	case "aria2c":
+		if _, err := exec.LookPath("aria2c"); err != nil {
+			return nil, errors.Wrap(err, "the aria2c downloader requires aria2c to be installed")
+		}
+		return aria2cDownloader{
+			ctl:         ctl,
+			renewer:     r,
+			parallel:    flags.Parallel,
+			connections: flags.Aria2cConnections,
+			split:       flags.Aria2cSplit,
+			rate:        flags.MaxRate,
+		}, nil
+	}
+	return nil, errors.Errorf("unknown downloader: %s", flags.Downloader)
+}
+
+// nativeDownloader fetches parallel files at a time over HTTP itself,
+// splitting each file of a known size across parts connections when
+// there's more than one. With verify, a file's md5 is checked while it's
+// downloaded, and with progress how much of it has arrived is printed.
+type nativeDownloader struct {
+	ctl      *control
+	renewer  renewer
+	parallel int
+	parts    int
+	verify   bool
+	progress bool
+	timeout  time.Duration
+}
+
+func (d nativeDownloader) download(jobs []*job) {
+	parallel(jobs, d.parallel, func(j *job) {
+		d.ctl.wait()
+		if !d.ctl.begin(j) {
+			return
+		}
+		d.renewer.renew(j)
+		md5 := ""
+		if d.verify {
+			md5 = j.file.Md5Hash
+		}
+		var progress awsutil.Progress
+		if d.progress {
+			progress = printProgress(j.path)
+		}
+		ctx, cancel := d.ctl.fileContext(d.timeout)
+		j.file.Link, j.err = d.renewer.client().Retry(j.acc, j.file.Name, j.file.Link, func(link string) error {
+			// both pick up where the refused attempt left off
+			if d.parts > 1 {
+				if size, ok := awsutil.RangeSize(ctx, link); ok {
+					stats, err := awsutil.DownloadSplitContext(ctx, link, j.path, size, d.parts, md5, progress)
+					j.record(stats)
+					return err
+				}
+				twig.Debugf("can't split %s, downloading it over one connection", j.path)
+			}
+			stats, err := awsutil.GetObjectToFileContext(ctx, link, j.path, md5, progress)
+			j.record(stats)
+			return err
+		})
+		d.ctl.timedOut(j, ctx, d.timeout)
+		cancel()
+		j.verified = j.err == nil && md5 != ""
+		d.ctl.finished(j)
+	})
+}
+
+// s3Downloader streams parallel files at a time into dest, never writing
+// them to disk. A job's path is the s3:// url it's copied to. With verify,
+// a file's md5 is checked before the object is finished, so one that
+// doesn't match never shows up in the bucket.
+type s3Downloader struct {
+	dest     *awsutil.S3Dest
+	ctl      *control
+	renewer  renewer
+	parallel int
+	verify   bool
+	progress bool
+	timeout  time.Duration
+}
+
+func (d s3Downloader) download(jobs []*job) {
+	parallel(jobs, d.parallel, func(j *job) {
+		d.ctl.wait()
+		if !d.ctl.begin(j) {
+			return
+		}
+		d.renewer.renew(j)
+		md5 := ""
+		if d.verify {
+			md5 = j.file.Md5Hash
+		}
+		var progress awsutil.Progress
+		if d.progress {
+			progress = printProgress(j.path)
+		}
+		ctx, cancel := d.ctl.fileContext(d.timeout)
+		size, _ := j.file.ParsedSize()
+		key := d.dest.Key(j.acc, j.file.Name)
+		j.file.Link, j.err = d.renewer.client().Retry(j.acc, j.file.Name, j.file.Link, func(link string) error {
+			stats, err := d.dest.CopyObject(ctx, link, key, size, md5, progress)
+			j.record(stats)
+			j.bytes = stats.BytesWritten
+			return err
+		})
+		d.ctl.timedOut(j, ctx, d.timeout)
+		cancel()
+		j.verified = j.err == nil && md5 != ""
+		d.ctl.finished(j)
+	})
+}
+
+// printProgress returns a Progress printing a line for the file at path
+// each time it's called.
+func printProgress(path string) awsutil.Progress {
+	return func(done, total int64) {
+		if total < 0 {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, formatSize(done))
+			return
+		}
+		pct := 100.0
+		if total > 0 {
+			pct = float64(done) * 100 / float64(total)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s of %s (%.0f%%)\n", path, formatSize(done), formatSize(total), pct)
+	}
+}
+
+// curlDownloader shells out to curl once per file, for parallel files at a
+// time. It's only used when asked for, the native downloader needs nothing
+// installed. A rate caps each curl in bytes per second. With verify, a
+// file's md5 is checked before it's given its real name.
+type curlDownloader struct {
+	ctl      *control
+	renewer  renewer
+	parallel int
+	rate     int64
+	verify   bool
+	timeout  time.Duration
+}
+
+func (d curlDownloader) download(jobs []*job) {
+	parallel(jobs, d.parallel, func(j *job) {
+		d.ctl.wait()
+		if !d.ctl.begin(j) {
+			return
+		}
+		d.renewer.renew(j)
+		// like the native downloader, only the finished file gets the real name
+		part := j.path + ".part"
+		args := []string{"--fail", "-o", part}
+		if d.rate > 0 {
+			args = append(args, "--limit-rate", strconv.FormatInt(d.rate, 10))
+		}
+		ctx, cancel := d.ctl.fileContext(d.timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "curl", append(args, j.file.Link)...)
+		cmd.Env = os.Environ()
+		j.err = cmd.Run()
+		if j.err == nil && d.verify && j.file.Md5Hash != "" {
+			j.err = awsutil.VerifyFileMD5(part, j.file.Md5Hash)
+			j.verified = j.err == nil
+		}
+		if j.err == nil {
+			j.err = awsutil.SyncFile(part)
+		}
+		if j.err == nil {
+			j.err = os.Rename(part, j.path)
+		}
+		if j.err == nil {
+			j.err = awsutil.SyncDir(filepath.Dir(j.path))
+		}
+		if j.err != nil {
+			os.Remove(part)
+		}
+		d.ctl.timedOut(j, ctx, d.timeout)
+		d.ctl.finished(j)
+	})
+}
+
+// aria2cDownloader hands the whole batch to a single aria2c invocation
+// through an input file, letting aria2c manage connections and resuming.
+// Being one batch, it can only be paused before it starts.
+type aria2cDownloader struct {
+	ctl         *control
+	renewer     renewer
+	parallel    int
+	connections int
+	split       int
+	// cap on all of aria2c's downloads together, in bytes per second
+	rate int64
+}
+
+func (d aria2cDownloader) download(jobs []*job) {
+	if len(jobs) == 0 {
+		return
+	}
+	d.ctl.wait()
+	var started []*job
+	for _, j := range jobs {
+		if d.ctl.begin(j) {
+			d.renewer.renew(j)
+			started = append(started, j)
+		}
+	}
+	jobs = started
+	if len(jobs) == 0 {
+		return
+	}
+	input, err := writeAria2cInput(jobs)
+	if err != nil {
+		for _, j := range jobs {
+			j.err = err
+		}
+		return
+	}
+	defer os.Remove(input)
+	args := []string{
+		"--input-file=" + input,
+		"--max-concurrent-downloads=" + strconv.Itoa(d.parallel),
+		"--max-connection-per-server=" + strconv.Itoa(d.connections),
+		"--split=" + strconv.Itoa(d.split),
+		"--continue=true",
+		"--auto-file-renaming=false",
+		"--allow-overwrite=true",
+		"--console-log-level=warn",
+	}
+	if d.rate > 0 {
+		args = append(args, "--max-overall-download-limit="+strconv.FormatInt(d.rate, 10))
+	}
+	cmd := exec.CommandContext(d.ctl.ctx, "aria2c", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		twig.Debugf("aria2c exited with: %s", err)
+	}
+	// aria2c only reports an aggregate exit status, so work out which
+	// files made it: a finished file exists without its control file.
+	for _, j := range jobs {
+		d.ctl.finished(j)
+		if _, err := os.Stat(j.path + ".aria2"); err == nil {
+			j.err = errors.New("aria2c did not finish the download")
+			d.ctl.timedOut(j, d.ctl.ctx, 0)
+			continue
+		}
+		if _, err := os.Stat(j.path); err != nil {
+			j.err = errors.Wrap(err, "aria2c did not produce the file")
+		}
+	}
+}
+
+// writeAria2cInput writes the jobs out in aria2c's input file format.
+// The file holds signed urls, so it is only readable by the user.
+func writeAria2cInput(jobs []*job) (string, error) {
+	f, err := ioutil.TempFile("", "sracp-aria2c-")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create input file for aria2c")
+	}
+	w := bufio.NewWriter(f)
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%s\n  dir=%s\n  out=%s\n", j.file.Link, filepath.Dir(j.path), filepath.Base(j.path))
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "couldn't write input file for aria2c")
+	}
+	return f.Name(), nil
+}
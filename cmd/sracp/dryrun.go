@@ -0,0 +1,61 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/mitre/fusera/nr"
+)
+
+// dryRun lists what a run would copy: every wanted file of each accession
+// with its size, and how much that comes to. Files whose size the API
+// didn't give are counted separately, since the total can't include them.
+func dryRun(w io.Writer, flags *Flags, accs map[string]nr.Accession, failures []failure) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCESSION\tFILE\tBYTES")
+	var total int64
+	files, unknown := 0, 0
+	for _, a := range sortedAccessions(accs) {
+		for _, f := range a.SortedFiles() {
+			if !flags.wants(f) {
+				continue
+			}
+			files++
+			size, err := f.ParsedSize()
+			if err != nil {
+				unknown++
+				fmt.Fprintf(tw, "%s\t%s\tunknown\n", a.ID, f.Name)
+				continue
+			}
+			total += size
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", a.ID, f.Name, size)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d files from %d accessions, %d bytes total", files, len(accs), total)
+	if unknown > 0 {
+		fmt.Fprintf(w, " not counting %d files of unknown size", unknown)
+	}
+	fmt.Fprintln(w)
+	for _, f := range failures {
+		fmt.Fprintln(w, f)
+	}
+	return nil
+}
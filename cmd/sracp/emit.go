@@ -0,0 +1,78 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// emittedURL is one file for an outside tool to fetch.
+type emittedURL struct {
+	Acc  string `json:"accession"`
+	File string `json:"file"`
+	URL  string `json:"url"`
+	Path string `json:"path"`
+	Size string `json:"size,omitempty"`
+	Md5  string `json:"md5,omitempty"`
+}
+
+// emitURLs writes the link of each wanted file along with where it would
+// have been copied to, so another tool can do the transfer. A name ending
+// in .json gets a JSON array, anything else a line per file of the url and
+// path separated by a tab. The urls are signed, so only the user can read it.
+func emitURLs(name string, wanted []wantedFile) error {
+	sort.Slice(wanted, func(i, j int) bool { return wanted[i].path < wanted[j].path })
+	urls := make([]emittedURL, 0, len(wanted))
+	for _, w := range wanted {
+		urls = append(urls, emittedURL{
+			Acc:  w.acc,
+			File: w.file.Name,
+			URL:  w.file.Link,
+			Path: w.path,
+			Size: w.file.Size,
+			Md5:  w.file.Md5Hash,
+		})
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create url list")
+	}
+	w := bufio.NewWriter(f)
+	if strings.HasSuffix(strings.ToLower(name), ".json") {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(urls)
+	} else {
+		for _, u := range urls {
+			if _, err = fmt.Fprintf(w, "%s\t%s\n", u.URL, u.Path); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "couldn't write url list %s", name)
+}
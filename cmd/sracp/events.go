@@ -0,0 +1,142 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/awsutil"
+	"github.com/pkg/errors"
+)
+
+// event is one step of a run, shipped to a remote sink so the runs on
+// many machines can be watched from one place.
+type event struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Node   string    `json:"node"`
+	Acc    string    `json:"accession,omitempty"`
+	File   string    `json:"file,omitempty"`
+	URL    string    `json:"url,omitempty"`
+	Region string    `json:"region,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Count  int       `json:"count,omitempty"`
+	Failed int       `json:"failed,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// eventWriteTimeout is how long sending an event may take. A sink that
+// takes longer is given up on for the rest of the run, so a stalled
+// collector can't hold up the copy.
+const eventWriteTimeout = 5 * time.Second
+
+// events sends each event as a line of JSON to a sink. A nil *events
+// sends nothing, so callers don't need to check whether a sink was given.
+type events struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// whether each line is wrapped in a syslog message
+	syslog bool
+	node   string
+}
+
+// newEvents connects to sink, one of syslog+udp://host:port,
+// syslog+tcp://host:port, udp://host:port or tcp://host:port. The syslog
+// forms wrap each event in a syslog message, the others send bare lines.
+func newEvents(sink string) (*events, error) {
+	if sink == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(sink)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("event sink must look like syslog+udp://host:514 or tcp://host:port, got: %s", sink)
+	}
+	// the connection is dialed here rather than by log/syslog, whose
+	// writes can't be given a deadline
+	network, wrap := u.Scheme, strings.HasPrefix(u.Scheme, "syslog+")
+	if wrap {
+		network = u.Scheme[len("syslog+"):]
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, errors.Errorf("event sink scheme must be syslog+udp, syslog+tcp, udp or tcp, got: %s", u.Scheme)
+	}
+	conn, err := net.DialTimeout(network, u.Host, 10*time.Second)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't connect to event sink %s", sink)
+	}
+	node, _ := os.Hostname()
+	return &events{conn: conn, syslog: wrap, node: node}, nil
+}
+
+// emit sends ev. Losing an event isn't worth failing a run over, so
+// problems are only logged.
+func (e *events) emit(ev event) {
+	if e == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.Node = e.node
+	// signed urls are credentials, never let one leave the machine,
+	// including inside an error from the http client, which may quote a
+	// renewed or redirected url rather than ev.URL
+	if ev.URL != "" {
+		redacted := awsutil.RedactURL(ev.URL)
+		ev.Error = strings.Replace(ev.Error, ev.URL, redacted, -1)
+		ev.URL = redacted
+	}
+	ev.Error = awsutil.RedactSignatures(ev.Error)
+	data, err := json.Marshal(ev)
+	if err != nil {
+		twig.Debugf("couldn't encode event: %s", err)
+		return
+	}
+	if e.syslog {
+		data = []byte(fmt.Sprintf("<%d>%s %s sracp[%d]: %s", syslog.LOG_INFO|syslog.LOG_DAEMON, ev.Time.Format(time.RFC3339), e.node, os.Getpid(), data))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if _, err := e.conn.Write(append(data, '\n')); err != nil {
+		twig.Debugf("couldn't send event: %s", err)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			twig.Infof("event sink stalled, sending no more events to it: %s\n", err)
+			e.conn.Close()
+			e.conn = nil
+		}
+	}
+}
+
+func (e *events) close() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		e.conn.Close()
+	}
+}
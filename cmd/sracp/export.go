@@ -0,0 +1,113 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+// runInfoColumns are the columns of NCBI's RunInfo CSV, in order.
+var runInfoColumns = []string{
+	"Run", "ReleaseDate", "LoadDate", "spots", "bases", "spots_with_mates",
+	"avgLength", "size_MB", "AssemblyName", "download_path", "Experiment",
+	"LibraryName", "LibraryStrategy", "LibrarySelection", "LibrarySource",
+	"LibraryLayout", "InsertSize", "InsertDev", "Platform", "Model",
+	"SRAStudy", "BioProject", "Study_Pubmed_id", "ProjectID", "Sample",
+	"BioSample", "SampleType", "TaxID", "ScientificName", "SampleName",
+	"g1k_pop_code", "source", "g1k_analysis_group", "Subject_ID", "Sex",
+	"Disease", "Tumor", "Affection_Status", "Analyte_Type",
+	"Histological_Type", "Body_Site", "CenterName", "Submission",
+	"dbgap_study_accession", "Consent", "RunHash", "ReadHash",
+}
+
+// export resolves the accessions in flags and writes what the API said
+// about them to stdout in flags.Format.
+func export(flags *Flags) error {
+	accs, issues, err := resolve(context.Background(), flags)
+	// stdout is for the export itself
+	for _, issue := range issues {
+		fmt.Fprintln(os.Stderr, issue)
+	}
+	if err != nil {
+		return err
+	}
+	sorted := sortedAccessions(accs)
+	switch flags.Format {
+	case "runinfo":
+		return writeRunInfo(os.Stdout, sorted)
+	default:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sorted)
+	}
+}
+
+// writeRunInfo writes one RunInfo row per accession. The API only knows
+// about files, so the columns describing the run come from its sra file
+// and every column about the experiment, sample or study is left blank.
+func writeRunInfo(w io.Writer, accs []nr.Accession) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(runInfoColumns); err != nil {
+		return errors.Wrap(err, "couldn't write runinfo header")
+	}
+	index := make(map[string]int, len(runInfoColumns))
+	for i, c := range runInfoColumns {
+		index[c] = i
+	}
+	for _, a := range accs {
+		row := make([]string, len(runInfoColumns))
+		row[index["Run"]] = a.ID
+		if f, ok := runFile(a); ok {
+			if !f.ModifiedDate.IsZero() {
+				row[index["LoadDate"]] = f.ModifiedDate.UTC().Format("2006-01-02 15:04:05")
+			}
+			if size, err := f.ParsedSize(); err == nil {
+				row[index["size_MB"]] = strconv.FormatInt(size/(1024*1024), 10)
+			}
+			row[index["download_path"]] = f.Link
+			row[index["RunHash"]] = f.Md5Hash
+		}
+		if err := cw.Write(row); err != nil {
+			return errors.Wrapf(err, "couldn't write runinfo row for %s", a.ID)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runFile picks the file that stands for the run as a whole: its sra file
+// if it has one, otherwise the first by name.
+func runFile(a nr.Accession) (nr.File, bool) {
+	files := a.SortedFiles()
+	if len(files) == 0 {
+		return nr.File{}, false
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name) == ".sra" || f.Name == a.ID {
+			return f, true
+		}
+	}
+	return files[0], true
+}
@@ -17,15 +17,20 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
 	"text/template"
+	"time"
 
 	"github.com/mattrbianchi/twig"
 	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/jsonlog"
+	"github.com/mitre/fusera/nr"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -72,53 +77,394 @@ COPYRIGHT:
 
 var VersionHash string
 
-func NewApp() (app *cli.App) {
+var debugFlag = cli.BoolFlag{
+	Name:   "debug",
+	Usage:  "Enable debugging output.",
+	EnvVar: "SRACP_DEBUG",
+}
+
+var quietFlag = cli.BoolFlag{
+	Name:   "quiet, q",
+	Usage:  "only log errors, leaving out the messages about each file, for batch jobs copying thousands of them.",
+	EnvVar: "SRACP_QUIET",
+}
+
+var verboseFlag = cli.BoolFlag{
+	Name:  "verbose, v",
+	Usage: "log what's being done, the default without --quiet. -vv logs the debugging output too.",
+}
+
+var veryVerboseFlag = cli.BoolFlag{
+	Name:  "vv",
+	Usage: "log everything, like --debug.",
+}
 
+// logFlags are the flags for what's logged and how, which every command takes.
+func logFlags() []cli.Flag {
+	return []cli.Flag{debugFlag, quietFlag, verboseFlag, veryVerboseFlag, logFormatFlag}
+}
+
+var logFormatFlag = cli.StringFlag{
+	Name:   "log-format",
+	Value:  "text",
+	Usage:  "text, or json to log one JSON object per line with its level, time, message and the accession and file it's about, for CloudWatch, ELK and the like.",
+	EnvVar: "SRACP_LOG_FORMAT",
+}
+
+// resolveFlags are the flags needed to ask the Name Resolver API about
+// accessions, shared by copying and prewarming.
+func resolveFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "ngc",
+			Usage:  "path to an ngc file that contains authentication info, on local disk or an s3 or gs:// url. Use - to pipe it in on stdin.",
+			EnvVar: "DBGAP_CREDENTIALS",
+		},
+		cli.StringFlag{
+			Name:   "ngc-credentials",
+			Usage:  "comma separated list of aws credential sources to try in order for s3, reading an ngc file and copying into a --dest bucket: default, env, profile:[name], or role:[arn].",
+			EnvVar: "FUSERA_NGC_CREDENTIALS",
+		},
+		cli.StringFlag{
+			Name:   "role-arn",
+			Usage:  "an IAM role to assume for s3, both to read the ngc file and to copy into a --dest bucket. The default aws credentials are what assume it. The same as --ngc-credentials role:[arn], which it can't be used with.",
+			EnvVar: "FUSERA_ROLE_ARN",
+		},
+		cli.StringFlag{
+			Name:   "ngc-region",
+			Usage:  "the region the ngc file's s3 bucket is in. Only needed when the url leaves it out, or for a region like us-gov-west-1 it can't be told from.",
+			EnvVar: "FUSERA_NGC_REGION",
+		},
+		cli.StringFlag{
+			Name:   "acc",
+			Usage:  "comma separated list of SRR#s that are to be mounted.",
+			EnvVar: "DBGAP_ACC",
+		},
+		cli.StringFlag{
+			Name:   "acc-file",
+			Usage:  "path to a file listing the accessions to copy, one per line or separated by commas or spaces, with # starting a comment. A Run Selector SraRunTable.csv works too.",
+			EnvVar: "DBGAP_ACCFILE",
+		},
+		cli.StringFlag{
+			Name:   "allow-prefixes",
+			Usage:  "comma separated list of accession prefixes, such as SRR,ERR. When set, any other accession is refused before anything is resolved.",
+			EnvVar: "FUSERA_ALLOW_PREFIXES",
+		},
+		cli.StringFlag{
+			Name:   "loc",
+			Usage:  "preferred region. On an amazon or google instance it's found from the instance metadata when not given, and elsewhere left out.",
+			EnvVar: "DBGAP_LOC",
+		},
+		cli.StringFlag{
+			Name:   "service",
+			Usage:  "which service's link to copy a file from when the API offers it from several, like s3 in AWS or gs in GCP to stay clear of egress charges. A comma separated list is tried in order, and a file from none of them is still copied from wherever it's available.",
+			EnvVar: "FUSERA_SERVICE",
+		},
+		cli.StringFlag{
+			Name:   "endpoint",
+			Usage:  "Change the endpoint sracp uses to communicate with NIH API. Only to be used for advanced purposes. Must be an absolute http(s) url.",
+			EnvVar: "FUSERA_NR_ENDPOINT,DBGAP_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "ca-cert",
+			Usage:  "trust the CA certificates in this PEM file as well as the system's, for every request made, to the Name Resolver API, for the ngc file and for data.",
+			EnvVar: "FUSERA_CA_CERT",
+		},
+		cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "skip verifying servers' certificates altogether. Only for testing against a server with a self-signed certificate.",
+		},
+		cli.StringFlag{
+			Name:   "nr-version",
+			Value:  nr.DefaultVersion,
+			Usage:  "version of the Name Resolver API's protocol to ask for.",
+			EnvVar: "FUSERA_NR_VERSION",
+			Hidden: true,
+		},
+		cli.StringFlag{
+			Name:   "nr-pin",
+			Usage:  "comma separated list of certificate pins, base64 sha256 public keys or hex sha256 fingerprints. When set, the API's certificate chain must match one of them.",
+			EnvVar: "FUSERA_NR_PIN",
+		},
+		cli.DurationFlag{
+			Name:  "wait-for-endpoint",
+			Usage: "keep checking for up to this long (e.g. 2m) for the API to become reachable before giving up. Off by default.",
+		},
+		cli.IntFlag{
+			Name:  "resolve-retries",
+			Value: nr.MaxRetries,
+			Usage: "how many more times to ask the Name Resolver API after a network error or a 5xx or 429 response, backing off a little longer each time.",
+		},
+		cli.DurationFlag{
+			Name:  "refresh-margin",
+			Value: nr.RefreshMargin,
+			Usage: "resolve a url again if it expires within this long, rather than start a transfer with it.",
+		},
+		cli.StringFlag{
+			Name:   "cache-dir",
+			Usage:  "directory of resolved urls cached by prewarm. When set, cached urls that haven't expired are used instead of asking the API again.",
+			EnvVar: "FUSERA_CACHE_DIR",
+		},
+	}
+}
+
+func NewApp() (app *cli.App) {
+	// -v is for --verbose
+	cli.VersionFlag = cli.BoolFlag{
+		Name:  "version",
+		Usage: "print the version",
+	}
 	app = &cli.App{
 		Name:     "sracp",
 		Version:  "0.0.-" + VersionHash,
 		Usage:    "",
 		HideHelp: true,
 		Writer:   os.Stderr,
-		Flags: []cli.Flag{
+		Flags: append(append([]cli.Flag{
 			cli.BoolFlag{
 				Name:  "help, h",
 				Usage: "Print this help text and exit successfully.",
 			},
 			cli.StringFlag{
-				Name:   "ngc",
-				Usage:  "path to an ngc file that contains authentication info.",
-				EnvVar: "DBGAP_CREDENTIALS",
+				Name:   "only, file-types",
+				Usage:  "comma separated list of file types to copy, like bam or fastq.gz, in any case.",
+				EnvVar: "DBGAP_ONLY",
+			},
+			cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "only copy files whose names match this glob, like *_R1_*. Can be given more than once to match any of several. A file must also be of a type given with --only, if any were.",
+			},
+			cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "don't copy files whose names match this glob, even if they match --include or --only. Can be given more than once.",
 			},
 			cli.StringFlag{
-				Name:   "acc",
-				Usage:  "comma separated list of SRR#s that are to be mounted.",
-				EnvVar: "DBGAP_ACC",
+				Name:  "min-size",
+				Usage: "skip files smaller than this, like 1KB. Files the API gives no size for are still copied.",
 			},
 			cli.StringFlag{
-				Name:   "only, file-types",
-				Usage:  "comma separated list of file types to copy.",
-				EnvVar: "DBGAP_ONLY",
+				Name:  "max-size",
+				Usage: "skip files larger than this, like 100GB.",
 			},
 			cli.StringFlag{
-				Name:   "acc-file",
-				Usage:  "path to file with comma or space separated list of SRR#s that are to be mounted.",
-				EnvVar: "DBGAP_ACCFILE",
+				Name:   "downloader",
+				Value:  "native",
+				Usage:  "how files are transferred: native, curl, or aria2c.",
+				EnvVar: "SRACP_DOWNLOADER",
+			},
+			cli.IntFlag{
+				Name:  "parallel",
+				Value: 4,
+				Usage: "how many files to download at once.",
+			},
+			cli.IntFlag{
+				Name:  "file-parallel",
+				Value: 1,
+				Usage: "split each file across this many concurrent ranged requests, only used with --downloader=native. A file whose server doesn't take ranges is downloaded over one connection instead. An interrupted split download picks up with the parts it didn't finish.",
 			},
 			cli.StringFlag{
-				Name:   "loc",
-				Usage:  "preferred region.",
-				EnvVar: "DBGAP_LOC",
+				Name:  "max-rate, rate-limit",
+				Usage: "cap on total download speed in bytes per second across all files and parts of files, like 50MB. curl shares it out evenly between its --parallel downloads.",
+			},
+			cli.StringFlag{
+				Name:  "buffer-size",
+				Value: "1MiB",
+				Usage: "how much of a file is read off the network at a time, like 256KiB or 4MiB, from 32KiB to 64MiB. Bigger can be faster for large files over a fast link, at the cost of that much memory for every download at once. Only used with --downloader=native.",
+			},
+			cli.IntFlag{
+				Name:  "max-connections",
+				Usage: "bound on the requests in flight across all files and parts of files, 0 for no bound. Only used with --downloader=native.",
+			},
+			cli.IntFlag{
+				Name:  "max-conns-per-host",
+				Value: awsutil.MaxConnsPerHost,
+				Usage: "most connections open at once to any one host, such as an s3 endpoint, past which requests wait their turn. 0 for no limit. Only used with --downloader=native.",
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "copy every file even if it's already at its path with the right md5, or size when the API gives no md5, and even if there doesn't seem to be room for them all.",
+			},
+			cli.BoolFlag{
+				Name:  "skip-checksum",
+				Usage: "don't check copied files against the md5 the API gives for them, which takes a second read of the file with curl or aria2c. Files stored with --cas are always checked.",
+			},
+			cli.IntFlag{
+				Name:  "aria2c-connections",
+				Value: 4,
+				Usage: "maximum connections aria2c opens to one server, only used with --downloader=aria2c.",
+			},
+			cli.IntFlag{
+				Name:  "aria2c-split",
+				Value: 4,
+				Usage: "number of connections aria2c splits each file across, only used with --downloader=aria2c.",
+			},
+			cli.IntFlag{
+				Name:  "max-redirects",
+				Value: awsutil.MaxRedirects,
+				Usage: "how many redirects to follow when fetching a file, 0 to treat any redirect as an error.",
+			},
+			cli.IntFlag{
+				Name:  "data-retries",
+				Value: awsutil.MaxRetries,
+				Usage: "times to retry fetching part of a file after a 5xx or 429 response or a network error. A 403, 404 or other error fails straight away.",
+			},
+			cli.DurationFlag{
+				Name:  "data-max-backoff",
+				Value: awsutil.MaxBackoff,
+				Usage: "cap on the exponentially growing wait between data-retries, 0 to retry without waiting.",
 			},
 			cli.StringFlag{
-				Name:   "endpoint",
-				Usage:  "Change the endpoint sracp uses to communicate with NIH API. Only to be used for advanced purposes.",
-				EnvVar: "DBGAP_ENDPOINT",
+				Name:  "dest",
+				Usage: "copy into s3://bucket/prefix instead of to disk, streaming each file straight into accession/name under the prefix. The bucket's region is looked up and the usual AWS credentials are used. The path is then only where the list of failures goes, the current directory when it's left off.",
 			},
 			cli.BoolFlag{
-				Name:   "debug",
-				Usage:  "Enable debugging output.",
-				EnvVar: "SRACP_DEBUG",
+				Name:  "cas",
+				Usage: "store files by md5 under path/cas, with each accession's directory holding symlinks into it, so files shared between accessions are only stored once.",
+			},
+			cli.StringFlag{
+				Name:  "pause-file",
+				Usage: "while this file exists, no new downloads are started. Sending SIGUSR1 also pauses and SIGUSR2 resumes.",
+			},
+			cli.DurationFlag{
+				Name:  "heartbeat",
+				Value: 30 * time.Second,
+				Usage: "how often to log progress and whether downloads are paused, so a stalled copy is soon noticed. 0 to turn off.",
+			},
+			cli.DurationFlag{
+				Name:  "file-timeout",
+				Usage: "give up on a file that hasn't finished downloading after this long, like 6h, counting it as failed and carrying on with the rest. 0 waits forever. Not used with --downloader=aria2c.",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "stop the whole run after this long, like 12h, cancelling the downloads in flight. Files already copied are kept and reported as usual, and the rest are listed as failed to retry, leaving what arrived of them to resume. 0 never stops.",
+			},
+			cli.BoolFlag{
+				Name:  "keep-partial",
+				Usage: "when stopped with Ctrl-C or SIGTERM, leave the files still downloading in place for the next run to resume, rather than removing them.",
+			},
+			cli.BoolFlag{
+				Name:  "progress",
+				Usage: "print how much of each file has arrived as it downloads, about once a second. Only the native downloader reports it.",
+			},
+			cli.StringFlag{
+				Name:  "manifest",
+				Usage: "write a record of every file to this path: its accession, name, local path, size, md5 and whether it was copied, failed or skipped. A name ending in .tsv gets a TSV, otherwise JSON that sracp diff can compare.",
+			},
+			cli.BoolFlag{
+				Name:  "ro-crate",
+				Usage: "write an RO-Crate, ro-crate-metadata.json, describing every file copied with its checksum, size, source and how it was resolved.",
+			},
+			cli.StringFlag{
+				Name:   "event-sink",
+				Usage:  "also send an event for the start and end of the run and each accession and file to a remote log, as a line of JSON: syslog+udp://host:514, syslog+tcp://host:port, udp://host:port or tcp://host:port.",
+				EnvVar: "SRACP_EVENT_SINK",
+			},
+			cli.DurationFlag{
+				Name:  "resolve-timeout",
+				Usage: "give up resolving after this long (e.g. 10m), copying the accessions resolved by then unless --strict is set. Off by default.",
+			},
+			cli.BoolFlag{
+				Name:  "strict",
+				Usage: "abort the run rather than copy only some of the accessions when resolving them stops partway, or when one returns a different number of files than --expect-files.",
+			},
+			cli.IntFlag{
+				Name:  "expect-files",
+				Usage: "warn about any accession the API returns a different number of files for, such as 2 for paired-end runs. With --strict the run is aborted instead. 0 to not check.",
+			},
+			cli.StringFlag{
+				Name:  "expect-files-map",
+				Usage: "path to a file giving the expected number of files of particular accessions, a line each of the accession and the count. Accessions not in it are held to --expect-files.",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "resolve the accessions and list the files that would be copied with their sizes and the total, without creating or downloading anything. Exits non-zero if any accession wasn't resolved.",
+			},
+			cli.BoolFlag{
+				Name:  "verify-only",
+				Usage: "resolve the accessions and check the files already under path against their sizes and md5s, listing which are fine, missing or corrupt, without downloading anything. Exits non-zero if any aren't fine.",
+			},
+			cli.StringFlag{
+				Name:  "emit-urls",
+				Usage: "don't copy anything, instead write the url of every file and the path it would be copied to into this file, for another tool to transfer. A name ending in .json gets JSON, otherwise a tab separated line per file.",
+			},
+			cli.BoolFlag{
+				Name:  "failed-files-json",
+				Usage: "along with the failed.txt list of accessions to retry, write failed-files.json detailing every file that failed and why.",
+			},
+			cli.StringFlag{
+				Name:  "error-file",
+				Usage: "write every accession or file that failed to this path, with the API's status and the reason, as a TSV or as JSON when the name ends in .json.",
+			},
+			cli.StringFlag{
+				Name:  "retry-failed",
+				Usage: "the --error-file of an earlier run, to copy again just what it lists as failed: the files named, and every file of an accession that failed as a whole. Whatever fails again is written back to it, unless --error-file says where else.",
+			},
+		}, resolveFlags()...), logFlags()...),
+		Commands: []cli.Command{
+			{
+				Name:  "prewarm",
+				Usage: "resolve accessions ahead of time, caching their urls for a later run",
+				Flags: append(resolveFlags(), logFlags()...),
+				Action: func(c *cli.Context) error {
+					flags, err := PopulatePrewarmFlags(c)
+					if err != nil {
+						fmt.Printf("\ninvalid arguments: %s\n\n", errors.Cause(err))
+						twig.Debugf("%+#v", err.Error())
+						return err
+					}
+					defer nr.WipeNgc(flags.Ngc)
+					return prewarm(flags)
+				},
+			},
+			{
+				Name:  "resolve",
+				Usage: "resolve accessions and print what the API knows about their files, without copying anything",
+				Flags: append(append(resolveFlags(), cli.StringFlag{
+					Name:  "format",
+					Value: "json",
+					Usage: "json, or runinfo for a CSV in the shape of NCBI's RunInfo table.",
+				}), logFlags()...),
+				Action: func(c *cli.Context) error {
+					flags, err := PopulateExportFlags(c)
+					if err != nil {
+						fmt.Printf("\ninvalid arguments: %s\n\n", errors.Cause(err))
+						twig.Debugf("%+#v", err.Error())
+						return err
+					}
+					defer nr.WipeNgc(flags.Ngc)
+					return export(flags)
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "compare the files recorded in two manifests, exiting with 1 if they differ",
+				ArgsUsage: "manifestA.json manifestB.json",
+				Flags:     logFlags(),
+				Action: func(c *cli.Context) error {
+					twig.SetDebug(c.Bool("debug"))
+					if err := jsonlog.SetFormat(c.String("log-format"), os.Stderr); err != nil {
+						return err
+					}
+					if err := jsonlog.SetVerbosity(c.Bool("quiet"), c.Bool("verbose"), c.Bool("vv") || c.Bool("debug")); err != nil {
+						return err
+					}
+					if c.NArg() != 2 {
+						fmt.Printf("\ninvalid arguments: %s\n\n", "must give two manifests to compare")
+						return errors.New("must give two manifests to compare")
+					}
+					a, err := readManifest(c.Args().Get(0))
+					if err != nil {
+						return err
+					}
+					b, err := readManifest(c.Args().Get(1))
+					if err != nil {
+						return err
+					}
+					if diffManifests(os.Stdout, a, b) {
+						return cli.NewExitError("", 1)
+					}
+					return nil
+				},
 			},
 		},
 	}
@@ -130,7 +476,7 @@ func NewApp() (app *cli.App) {
 
 	flagCategories = map[string]string{}
 
-	for _, f := range []string{"help, h", "debug", "version, v"} {
+	for _, f := range []string{"help, h", "debug", "quiet, q", "verbose, v", "vv", "version"} {
 		flagCategories[f] = "misc"
 	}
 
@@ -147,57 +493,390 @@ type Flags struct {
 	Ngc      []byte
 	Acc      map[string]bool
 	Types    map[string]bool
+	Include  []string
+	Exclude  []string
+	MinSize  int64
+	MaxSize  int64
 	Loc      string
 	Path     string
 	Debug    bool
 	Endpoint string
+	CacheDir string
+
+	WaitForEndpoint time.Duration
+	ResolveTimeout  time.Duration
+	Strict          bool
+
+	ExpectFiles    int
+	ExpectFilesFor map[string]int
+
+	Downloader        string
+	Parallel          int
+	FileParallel      int
+	SkipChecksum      bool
+	Force             bool
+	MaxRate           int64
+	Aria2cConnections int
+	Aria2cSplit       int
+
+	FailedFilesJSON bool
+	ErrorFile       string
+	EmitURLs        string
+	DryRun          bool
+	VerifyOnly      bool
+	EventSink       string
+	ROCrate         bool
+	Manifest        string
+
+	// Retry holds, for each accession of the RetryFailed error file, the
+	// files to copy again, nil for all of them.
+	RetryFailed string
+	Retry       map[string]map[string]bool
+
+	Format string
+
+	Dest      *awsutil.S3Dest
+	CAS       bool
+	PauseFile string
+	Heartbeat time.Duration
+	Progress  bool
+
+	KeepPartial bool
+	FileTimeout time.Duration
+	Timeout     time.Duration
 }
 
-func reconcileAccs(data []byte) []string {
-	accs := strings.Split(string(data), ",")
-	if len(accs) != 1 {
-		return accs
+// Add the flags accepted by run to the supplied flag set, returning the
+// variables into which the flags will parse.
+func PopulateFlags(c *cli.Context) (ret *Flags, err error) {
+	dest := c.String("dest")
+	// these only resolve, and read what's already under the path at most,
+	// so it can be left to be the current directory
+	copying := !c.Bool("dry-run") && c.String("emit-urls") == "" && !c.Bool("verify-only")
+	if len(c.Args()) > 1 || (len(c.Args()) == 0 && dest == "" && copying) {
+		return nil, errors.New("must give a path to copy files to")
+	}
+	f, err := populateResolveFlags(c)
+	if err != nil {
+		return nil, err
 	}
-	accs = strings.Split(string(data), " ")
-	if len(accs) != 1 {
-		return accs
+	f.Path = c.Args().Get(0)
+	if f.Path == "" {
+		f.Path = "."
 	}
-	accs = strings.Split(string(data), "\n")
-	return vetAccs(accs)
+	f.Downloader = c.String("downloader")
+	f.Parallel = c.Int("parallel")
+	f.FileParallel = c.Int("file-parallel")
+	f.SkipChecksum = c.Bool("skip-checksum")
+	f.Force = c.Bool("force")
+	f.Aria2cConnections = c.Int("aria2c-connections")
+	f.Aria2cSplit = c.Int("aria2c-split")
+	f.FailedFilesJSON = c.Bool("failed-files-json")
+	f.ErrorFile = c.String("error-file")
+	if f.RetryFailed != "" && f.ErrorFile == "" {
+		f.ErrorFile = f.RetryFailed
+	}
+	f.Manifest = c.String("manifest")
+	f.EmitURLs = c.String("emit-urls")
+	f.DryRun = c.Bool("dry-run")
+	f.VerifyOnly = c.Bool("verify-only")
+	if f.VerifyOnly && (f.DryRun || f.EmitURLs != "") {
+		return nil, errors.New("verify-only can't be combined with dry-run or emit-urls")
+	}
+	f.ExpectFiles = c.Int("expect-files")
+	if f.ExpectFiles < 0 {
+		return nil, errors.New("expect-files can't be negative")
+	}
+	if path := c.String("expect-files-map"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't open expect-files-map at: %s", path)
+		}
+		f.ExpectFilesFor, err = parseExpectedCounts(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid expect-files-map %s", path)
+		}
+	}
+	f.EventSink = c.String("event-sink")
+	f.ROCrate = c.Bool("ro-crate")
+	f.CAS = c.Bool("cas")
+	if dest != "" {
+		if f.CAS || f.ROCrate || f.VerifyOnly {
+			return nil, errors.New("cas, ro-crate and verify-only need files on disk, they can't be used with dest")
+		}
+		if c.IsSet("downloader") && c.String("downloader") != "native" {
+			return nil, errors.New("dest does its own copying, it can't be used with another downloader")
+		}
+		sources, err := credentialSources(c)
+		if err != nil {
+			return nil, err
+		}
+		if f.Dest, err = awsutil.NewS3DestWith(dest, sources); err != nil {
+			return nil, err
+		}
+	}
+	f.PauseFile = c.String("pause-file")
+	f.Heartbeat = c.Duration("heartbeat")
+	f.Progress = c.Bool("progress")
+	f.KeepPartial = c.Bool("keep-partial")
+	f.FileTimeout = c.Duration("file-timeout")
+	if f.FileTimeout < 0 {
+		return nil, errors.New("file-timeout can't be negative")
+	}
+	f.Timeout = c.Duration("timeout")
+	if f.Timeout < 0 {
+		return nil, errors.New("timeout can't be negative")
+	}
+	f.ResolveTimeout = c.Duration("resolve-timeout")
+	f.Strict = c.Bool("strict")
+	if f.ResolveTimeout < 0 {
+		return nil, errors.New("resolve-timeout can't be negative")
+	}
+	if c.Int("max-redirects") < 0 {
+		return nil, errors.New("max-redirects can't be negative")
+	}
+	awsutil.MaxRedirects = c.Int("max-redirects")
+	if c.Int("data-retries") < 0 {
+		return nil, errors.New("data-retries can't be negative")
+	}
+	awsutil.MaxRetries = c.Int("data-retries")
+	if c.Duration("data-max-backoff") < 0 {
+		return nil, errors.New("data-max-backoff can't be negative")
+	}
+	awsutil.MaxBackoff = c.Duration("data-max-backoff")
+	switch f.Downloader {
+	case "native", "curl", "aria2c":
+	default:
+		return nil, errors.Errorf("downloader must be one of native, curl, or aria2c, got: %s", f.Downloader)
+	}
+	if f.Parallel < 1 {
+		return nil, errors.New("parallel must be at least 1")
+	}
+	if f.FileParallel < 1 {
+		return nil, errors.New("file-parallel must be at least 1")
+	}
+	if c.Int("max-connections") < 0 {
+		return nil, errors.New("max-connections can't be negative")
+	}
+	awsutil.SetMaxConnections(c.Int("max-connections"))
+	if c.Int("max-conns-per-host") < 0 {
+		return nil, errors.New("max-conns-per-host can't be negative")
+	}
+	awsutil.SetMaxConnsPerHost(c.Int("max-conns-per-host"))
+	size, err := parseSize(c.String("buffer-size"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid buffer-size")
+	}
+	if size < awsutil.MinCopyBufferSize || size > awsutil.MaxCopyBufferSize {
+		return nil, errors.Errorf("buffer-size must be from 32KiB to 64MiB, got %s", c.String("buffer-size"))
+	}
+	awsutil.CopyBufferSize = int(size)
+	if c.String("max-rate") != "" {
+		f.MaxRate, err = parseSize(c.String("max-rate"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid max-rate")
+		}
+		awsutil.SetRateLimit(f.MaxRate)
+	}
+	if f.Aria2cConnections < 1 || f.Aria2cSplit < 1 {
+		return nil, errors.New("aria2c-connections and aria2c-split must be at least 1")
+	}
+
+	types := strings.Split(c.String("only"), ",")
+	if len(types) == 1 && types[0] == "" {
+		types = nil
+	}
+	if len(types) > 0 {
+		for _, t := range types {
+			if t != "" {
+				f.Types[strings.ToLower(strings.TrimLeft(strings.TrimSpace(t), "."))] = true
+			}
+		}
+	}
+	f.Include = c.StringSlice("include")
+	f.Exclude = c.StringSlice("exclude")
+	for _, p := range append(f.Include, f.Exclude...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid glob %q", p)
+		}
+	}
+	if s := c.String("min-size"); s != "" {
+		if f.MinSize, err = parseSize(s); err != nil {
+			return nil, errors.Wrap(err, "invalid min-size")
+		}
+	}
+	if s := c.String("max-size"); s != "" {
+		if f.MaxSize, err = parseSize(s); err != nil {
+			return nil, errors.Wrap(err, "invalid max-size")
+		}
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return nil, errors.New("min-size can't be more than max-size")
+	}
+	return f, nil
 }
 
-func vetAccs(accs []string) []string {
-	aa := make([]string, 0, len(accs))
-	for _, a := range accs {
-		if !strings.Contains(a, "SRR") ||
-			strings.Contains(a, " ") ||
-			strings.Contains(a, ",") ||
-			strings.Contains(a, "\n") {
-			continue
+// target is where the file name of accession acc is copied to, a path on
+// disk or an s3:// url under Dest.
+func (f *Flags) target(acc, name string) string {
+	if f.Dest != nil {
+		return f.Dest.URL(f.Dest.Key(acc, name))
+	}
+	return filepath.Join(f.Path, acc, name)
+}
+
+// wants reports whether file is to be copied, see skipReason.
+func (f *Flags) wants(file nr.File) bool {
+	return f.skipReason(file) == ""
+}
+
+// matchesAny reports whether name matches any of patterns, which are in
+// filepath.Match's syntax, and with the first one it matches.
+func matchesAny(patterns []string, name string) (string, bool) {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return p, true
 		}
-		aa = append(aa, a)
 	}
-	return aa
+	return "", false
 }
 
-// Add the flags accepted by run to the supplied flag set, returning the
-// variables into which the flags will parse.
-func PopulateFlags(c *cli.Context) (ret *Flags, err error) {
-	if len(c.Args()) != 1 {
-		return nil, errors.New("must give a path to copy files to")
+// hasType reports whether name ends in one of the types given with --only,
+// ignoring case. A type can span dots, so fastq.gz matches sample.fastq.gz
+// as gz does.
+func (f *Flags) hasType(name string) bool {
+	name = strings.ToLower(name)
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' && f.Types[name[i+1:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// skipReason says why file is left out by --exclude, --only, --include,
+// --min-size or --max-size, or is empty when it isn't. A file is only
+// wanted when it passes all of them that were given, so an --exclude wins
+// over everything else. A file whose size isn't known isn't left out for
+// its size.
+func (f *Flags) skipReason(file nr.File) string {
+	if p, ok := matchesAny(f.Exclude, file.Name); ok {
+		return "matches --exclude " + p
+	}
+	if len(f.Types) > 0 && !f.hasType(file.Name) {
+		return "not one of the types given with --only"
+	}
+	if _, ok := matchesAny(f.Include, file.Name); len(f.Include) > 0 && !ok {
+		return "doesn't match any --include"
+	}
+	size, err := file.ParsedSize()
+	if err != nil {
+		return ""
+	}
+	if f.MinSize > 0 && size < f.MinSize {
+		return fmt.Sprintf("%s is under --min-size", formatSize(size))
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return fmt.Sprintf("%s is over --max-size", formatSize(size))
+	}
+	return ""
+}
+
+// PopulatePrewarmFlags parses the flags of the prewarm command, which
+// always uses a cache, falling back to the default location.
+func PopulatePrewarmFlags(c *cli.Context) (*Flags, error) {
+	if c.NArg() != 0 {
+		return nil, errors.New("prewarm doesn't take a path")
+	}
+	f, err := populateResolveFlags(c)
+	if err != nil {
+		return nil, err
 	}
+	if f.CacheDir == "" {
+		f.CacheDir = nr.DefaultCacheDir()
+	}
+	return f, nil
+}
+
+// PopulateExportFlags parses the flags of the resolve command.
+func PopulateExportFlags(c *cli.Context) (*Flags, error) {
+	if c.NArg() != 0 {
+		return nil, errors.New("resolve doesn't take a path")
+	}
+	f, err := populateResolveFlags(c)
+	if err != nil {
+		return nil, err
+	}
+	f.Format = c.String("format")
+	switch f.Format {
+	case "json", "runinfo":
+	default:
+		return nil, errors.Errorf("format must be json or runinfo, got: %s", f.Format)
+	}
+	return f, nil
+}
+
+func populateResolveFlags(c *cli.Context) (ret *Flags, err error) {
 	f := &Flags{
 		Acc:   make(map[string]bool),
 		Types: make(map[string]bool),
-		Path:  c.Args()[0],
 		// Debugging,
 		Debug:    c.Bool("debug"),
 		Endpoint: c.String("endpoint"),
+		CacheDir: c.String("cache-dir"),
+
+		WaitForEndpoint: c.Duration("wait-for-endpoint"),
+	}
+	twig.SetDebug(f.Debug)
+	if err := jsonlog.SetFormat(c.String("log-format"), os.Stderr); err != nil {
+		return nil, err
+	}
+	if err := jsonlog.SetVerbosity(c.Bool("quiet"), c.Bool("verbose"), c.Bool("vv") || c.Bool("debug")); err != nil {
+		return nil, err
+	}
+	if err := nr.CheckEndpoint(f.Endpoint); err != nil {
+		return nil, err
+	}
+	if c.Duration("refresh-margin") < 0 {
+		return nil, errors.New("refresh-margin can't be negative")
+	}
+	nr.RefreshMargin = c.Duration("refresh-margin")
+	if c.Int("resolve-retries") < 0 {
+		return nil, errors.New("resolve-retries can't be negative")
+	}
+	nr.MaxRetries = c.Int("resolve-retries")
+	if c.Bool("insecure") && c.String("nr-pin") != "" {
+		return nil, errors.New("nr-pin only checks a verified certificate chain, it can't be used with insecure")
+	}
+	if c.String("ca-cert") != "" || c.Bool("insecure") {
+		cfg, err := awsutil.NewTLSConfig(c.String("ca-cert"), c.Bool("insecure"))
+		if err != nil {
+			return nil, err
+		}
+		if cfg.InsecureSkipVerify {
+			fmt.Fprintln(os.Stderr, "WARNING: --insecure is set, no server's certificate will be verified")
+		}
+		awsutil.SetTLSConfig(cfg)
+		nr.SetTLSConfig(cfg)
+	}
+	nr.Version = strings.TrimSpace(c.String("nr-version"))
+	if nr.Version == "" {
+		return nil, errors.New("nr-version can't be empty")
+	}
+	if pins := c.String("nr-pin"); pins != "" {
+		if err := nr.PinCertificates(strings.Split(pins, ",")); err != nil {
+			return nil, err
+		}
 	}
 	ngcpath := c.String("ngc")
 	if ngcpath != "" {
-		// we were given a path to an ngc file. Let's read it.
-		data, err := ioutil.ReadFile(ngcpath)
+		// we were given a path to an ngc file, or - for stdin. Let's read it.
+		awsutil.NgcRegion = c.String("ngc-region")
+		sources, err := credentialSources(c)
+		if err != nil {
+			return nil, err
+		}
+		data, err := awsutil.ReadNgcFileWith(ngcpath, sources)
 		if err != nil {
 			return nil, errors.Wrapf(err, "couldn't open ngc file at: %s", ngcpath)
 		}
@@ -222,40 +901,58 @@ func PopulateFlags(c *cli.Context) (ret *Flags, err error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "couldn't open acc file at: %s", accpath)
 		}
-		accs := reconcileAccs(data)
+		accs, err := nr.ParseAccessionList(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read acc file at: %s", accpath)
+		}
 		for _, a := range accs {
 			if a != "" {
 				f.Acc[a] = true
 			}
 		}
 	}
-	if len(aa) == 0 && accpath == "" {
-		return nil, errors.New("must provide at least one accession number")
-	}
-	loc := c.String("loc")
-	if !c.IsSet("loc") {
-		loc, err = awsutil.ResolveRegion()
+	// only copying takes retry-failed, for the rest it's always empty
+	if f.RetryFailed = c.String("retry-failed"); f.RetryFailed != "" {
+		failures, err := readErrorFile(f.RetryFailed)
 		if err != nil {
 			return nil, err
 		}
+		if len(failures) == 0 {
+			return nil, errors.Errorf("%s lists no failures, there's nothing to retry", f.RetryFailed)
+		}
+		f.Retry = retrySet(failures)
+		for a := range f.Retry {
+			f.Acc[a] = true
+		}
 	}
-	ok := awsutil.IsLocation(loc)
-	if !ok {
+	if len(aa) == 0 && accpath == "" && f.RetryFailed == "" {
+		return nil, errors.New("must provide at least one accession number")
+	}
+	if err := nr.CheckPrefixes(f.Acc, nr.ParsePrefixes(c.String("allow-prefixes"))); err != nil {
 		return nil, err
 	}
+	loc := c.String("loc")
+	if !c.IsSet("loc") {
+		loc = awsutil.DetectLocation()
+	}
+	if loc != "" && !awsutil.IsLocation(loc) {
+		return nil, errors.Errorf("gave location of %s, location must match one of these possibilities:\n%s", loc, awsutil.IncorrectLocationMessage)
+	}
 	f.Loc = loc
+	nr.PreferredServices = nr.ParseServices(c.String("service"))
+	return f, nil
+}
 
-	types := strings.Split(c.String("only"), ",")
-	if len(types) == 1 && types[0] == "" {
-		types = nil
-	}
-	if len(types) > 0 {
-		for _, t := range types {
-			if t != "" {
-				f.Types[t] = true
-			}
+// credentialSources is the list of aws credential sources given by
+// ngc-credentials, or the single role of role-arn, which is the same as
+// giving role:[arn] and so can't be used along with it.
+func credentialSources(c *cli.Context) ([]awsutil.CredentialSource, error) {
+	spec := c.String("ngc-credentials")
+	if arn := c.String("role-arn"); arn != "" {
+		if spec != "" {
+			return nil, errors.New("role-arn is the same as ngc-credentials role:[arn], give only one of them")
 		}
+		spec = "role:" + arn
 	}
-	twig.SetDebug(f.Debug)
-	return f, nil
+	return awsutil.ParseCredentialSources(spec)
 }
@@ -17,13 +17,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/jsonlog"
 	"github.com/mitre/fusera/nr"
 	"github.com/pkg/errors"
 
@@ -34,11 +38,13 @@ var Version = "beta"
 var flags *Flags
 
 func init() {
-	twig.SetFlags(twig.LstdFlags | twig.Lshortfile)
+	jsonlog.SetLevel(jsonlog.Info)
 }
 
 func main() {
 	VersionHash = Version
+	nr.UserAgent = "fusera-sracp/" + Version
+	awsutil.UserAgent = nr.UserAgent
 	EnsurePathIsSet()
 	var app = NewApp()
 	app.Action = func(c *cli.Context) error {
@@ -58,50 +64,283 @@ func main() {
 			twig.Debugf("%+#v", err.Error())
 			cli.ShowAppHelpAndExit(c, 1)
 		}
-		twig.Debugf("accs: %s", flags.Acc)
-		// TODO: go ask for URLs, run libcurl
-		accs, err := nr.ResolveNames(flags.Endpoint, flags.Loc, flags.Ngc, flags.Acc)
+		twig.Debugf("accs: %v", flags.Acc)
+		defer nr.WipeNgc(flags.Ngc)
+		ev, err := newEvents(flags.EventSink)
 		if err != nil {
 			return err
 		}
-		_, err = exec.LookPath("curl")
+		defer ev.close()
+		ev.emit(event{Event: "run-start", Count: len(flags.Acc)})
+		sum := newSummary()
+		ctx, cancel := runContext(flags.Timeout)
+		defer cancel()
+		ctl := newControl(ctx, flags.Timeout, flags.PauseFile, flags.KeepPartial)
+		defer ctl.cancel()
+		ctl.watchSignals()
+		dl, err := newDownloader(flags, ctl)
 		if err != nil {
-			// TODO: create better message describing that curl isnt installed
 			return err
 		}
-		for _, v := range accs {
-			err := os.Mkdir(filepath.Join(flags.Path, v.ID), 0755)
-			if err != nil {
-				twig.Infof("Issue creating directory for %s: %s\n", v.ID, err.Error())
+		accs, issues, err := resolve(ctl.ctx, flags)
+		reasons := make(map[string]nr.AccessionError)
+		var failures []failure
+		for _, issue := range issues {
+			fmt.Println(issue)
+			if issue.File == "" {
+				reasons[issue.ID] = issue
 				continue
 			}
-			for _, f := range v.Files {
-				if c.IsSet("only") {
-					ext := filepath.Ext(f.Name)
-					ext = strings.TrimLeft(ext, ".")
-					if _, ok := flags.Types[ext]; !ok {
-						continue
+			// a file the API gave nothing usable for was dropped, and has failed
+			if _, ok := accs[issue.ID].Files[issue.File]; !ok && flags.retrying(issue.ID, issue.File) {
+				failures = append(failures, failure{Acc: issue.ID, File: issue.File, Reason: "Name Resolver API: " + issue.Message})
+			}
+		}
+		if err != nil {
+			// what was resolved before the failure can still be copied,
+			// the rest is listed in failed.txt to retry
+			if len(accs) == 0 || flags.Strict {
+				return err
+			}
+			fmt.Printf("resolving stopped early, continuing with %d of %d accessions: %s\n", len(accs), len(flags.Acc), err)
+		}
+		resolved := time.Now()
+		for a := range flags.Acc {
+			if _, ok := accs[a]; !ok {
+				reason, status := "not resolved by the Name Resolver API", 0
+				if r, ok := reasons[a]; ok {
+					reason, status = "Name Resolver API: "+r.Message, r.Status
+				}
+				failures = append(failures, failure{Acc: a, Status: status, Reason: reason})
+				ev.emit(event{Event: "accession-failed", Acc: a, Error: reason})
+			}
+		}
+		for _, a := range accs {
+			ev.emit(event{Event: "accession-resolved", Acc: a.ID, Count: len(a.Files)})
+		}
+		if off := checkFileCounts(flags, accs); len(off) > 0 {
+			for _, f := range off {
+				fmt.Printf("issue with accession %s: %s\n", f.Acc, f.Reason)
+			}
+			if flags.Strict {
+				return errors.Errorf("%d accessions didn't return the expected number of files", len(off))
+			}
+		}
+		if flags.Retry != nil {
+			// after counting, which goes by all of an accession's files
+			dropRetried(flags, accs)
+		}
+		if flags.DryRun {
+			if err := dryRun(os.Stdout, flags, accs, failures); err != nil {
+				return err
+			}
+			if len(failures) > 0 {
+				return errors.New(unresolved(failures))
+			}
+			return nil
+		}
+		if flags.VerifyOnly {
+			return verifyOnly(os.Stdout, flags, accs, failures)
+		}
+		if flags.EmitURLs != "" {
+			var wanted []wantedFile
+			for _, v := range sortedAccessions(accs) {
+				for _, f := range v.SortedFiles() {
+					if flags.wants(f) {
+						wanted = append(wanted, wantedFile{acc: v.ID, file: f, path: flags.target(v.ID, f.Name)})
 					}
 				}
-				// TODO: call libcurl on each url to the path specified
-				args := []string{"-o", filepath.Join(flags.Path, v.ID, f.Name), f.Link}
-				cmd := exec.Command("curl", args...)
-				cmd.Env = os.Environ()
-				err := cmd.Run()
+			}
+			if err := emitURLs(flags.EmitURLs, wanted); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %d urls to %s\n", len(wanted), flags.EmitURLs)
+			if len(failures) > 0 {
+				fmt.Println(unresolved(failures))
+			}
+			return nil
+		}
+		var cas *casLayout
+		if flags.CAS {
+			cas = newCASLayout(flags.Path)
+		}
+		var jobs []*job
+		var wanted, skipped []wantedFile
+		for _, v := range sortedAccessions(accs) {
+			dir := filepath.Join(flags.Path, v.ID)
+			var err error
+			if flags.Dest == nil {
+				err = os.Mkdir(dir, 0755)
+			}
+			if os.IsExist(err) {
+				// left by an earlier run, whose files may well be done,
+				// unless it's something other than a directory
+				if fi, serr := os.Stat(dir); serr != nil {
+					err = serr
+				} else if !fi.IsDir() {
+					err = errors.Errorf("%s already exists and isn't a directory", dir)
+				} else {
+					err = nil
+				}
+			}
+			if err != nil {
+				jsonlog.Errorf("Issue creating directory for %s: %s\n", v.ID, err.Error())
+				failures = append(failures, failure{Acc: v.ID, Reason: err.Error()})
+				continue
+			}
+			for _, f := range v.SortedFiles() {
+				path := flags.target(v.ID, f.Name)
+				if reason := flags.skipReason(f); reason != "" {
+					twig.Infof("skipping %s: %s\n", path, reason)
+					skipped = append(skipped, wantedFile{acc: v.ID, file: f, path: path})
+					continue
+				}
+				wanted = append(wanted, wantedFile{acc: v.ID, file: f, path: path})
+				if !flags.Force && copiedBefore(flags, v.ID, f, path) {
+					twig.Infof("skipping %s, it's already been copied\n", path)
+					sum.alreadyThere()
+					continue
+				}
+				if cas == nil {
+					j := newJob(v.ID, f, path)
+					j.remote = flags.Dest != nil
+					jobs = append(jobs, j)
+					continue
+				}
+				j, err := cas.plan(v.ID, f, path)
 				if err != nil {
-					twig.Infof("Issue copying %s: %s\n", args[2], err.Error())
+					jsonlog.Errorf("Issue copying %s: %s\n", path, err.Error())
+					failures = append(failures, failure{Acc: v.ID, File: f.Name, Reason: err.Error()})
+					continue
+				}
+				if j != nil {
+					jobs = append(jobs, j)
+				}
+			}
+		}
+		regions := make([]string, 0, len(jobs))
+		for _, j := range jobs {
+			regions = append(regions, j.region)
+		}
+		if w := awsutil.LocationWarning(flags.Loc, regions); w != "" {
+			fmt.Println(w)
+		}
+		if flags.Dest == nil {
+			if err := checkSpace(flags.Path, jobs); err != nil {
+				if !flags.Force {
+					return errors.Errorf("%s, use --force to copy anyway", err)
+				}
+				fmt.Println(err)
+			}
+		}
+		ctl.start(len(jobs))
+		stop := ctl.heartbeat(flags.Heartbeat)
+		dl.download(jobs)
+		stop()
+		stats := make(regionStats)
+		// the job each file was copied by, by path, for the manifest
+		copied := make(map[string]*job)
+		for _, j := range jobs {
+			j.finish()
+			// a file going into the store is checked as it's committed
+			if !flags.SkipChecksum && j.final == "" {
+				j.verify()
+			}
+			if j.err == nil && cas != nil {
+				j.err = cas.commit(j)
+			}
+			stats.add(j)
+			if j.err != nil {
+				jsonlog.Errorf("Issue copying %s: %s\n", j.path, j.err.Error())
+				for _, f := range j.failures(j.err) {
+					failures = append(failures, f)
+					ev.emit(event{Event: "file-failed", Acc: f.Acc, File: f.File, URL: j.file.Link, Region: j.region, Error: f.Reason})
 				}
+				continue
+			}
+			twig.Debugf("copied %s bytes=%d fetched=%d in=%s retries=%d url=%s region=%s", j.path, j.bytes, j.stats.BytesWritten, j.stats.Duration, j.stats.Retries, awsutil.RedactURL(j.file.Link), j.region)
+			ev.emit(event{Event: "file-complete", Acc: j.acc, File: j.file.Name, URL: j.file.Link, Region: j.region, Bytes: j.bytes})
+			copied[j.path] = j
+			for _, link := range j.links {
+				copied[link.path] = j
+			}
+			sum.copiedFile(j)
+		}
+		stats.log()
+		fmt.Println(sum.String(len(flags.Acc), failures))
+		ev.emit(event{Event: "run-end", Count: len(jobs), Failed: len(failures)})
+		if flags.Manifest != "" {
+			if err := newManifest(wanted, skipped, failures, copied, flags.Dest == nil).write(flags.Manifest); err != nil {
+				return err
+			}
+		}
+		if err := writeFailures(flags.Path, failures, flags.FailedFilesJSON); err != nil {
+			return err
+		}
+		if flags.ErrorFile != "" {
+			if err := writeErrorFile(flags.ErrorFile, failures); err != nil {
+				return err
 			}
 		}
+		if flags.ROCrate {
+			if err := writeROCrate(flags.Path, wanted, failures, resolved, time.Now()); err != nil {
+				return err
+			}
+		}
+		if len(failures) > 0 {
+			msg := fmt.Sprintf("%d failures", len(failures))
+			if s := ctl.signal(); s != nil {
+				msg = fmt.Sprintf("stopped by %s, %s", s, msg)
+			}
+			if flags.ErrorFile != "" {
+				return errors.Errorf("%s, retry them with --retry-failed %s", msg, flags.ErrorFile)
+			}
+			return errors.Errorf("%s, retry them with --acc-file %s", msg, filepath.Join(flags.Path, failedListName))
+		}
 		return nil
 	}
 	err := app.Run(os.Args)
 	if err != nil {
-		twig.Infof("Error running command: %s\n", err.Error())
+		jsonlog.Errorf("Error running command: %s\n", err.Error())
 		os.Exit(1)
 	}
 }
 
+// resolve asks the Name Resolver API for the accessions in flags under
+// ctx, going through the cache when one was given.
+func resolve(ctx context.Context, flags *Flags) (map[string]nr.Accession, []nr.AccessionError, error) {
+	if err := waitForEndpoint(flags); err != nil {
+		return nil, nil, err
+	}
+	if flags.ResolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, flags.ResolveTimeout)
+		defer cancel()
+	}
+	if flags.CacheDir != "" {
+		return nr.ResolveNamesCached(ctx, &nr.Cache{Dir: flags.CacheDir}, flags.Endpoint, flags.Loc, flags.Ngc, flags.Acc)
+	}
+	return nr.ResolveNamesContext(ctx, flags.Endpoint, flags.Loc, flags.Ngc, flags.Acc)
+}
+
+// sortedAccessions returns accs ordered by accession, so files are copied
+// and reported in the same order from one run to the next.
+func sortedAccessions(accs map[string]nr.Accession) []nr.Accession {
+	sorted := make([]nr.Accession, 0, len(accs))
+	for _, a := range accs {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+func waitForEndpoint(flags *Flags) error {
+	if flags.WaitForEndpoint <= 0 {
+		return nil
+	}
+	return nr.WaitForEndpoint(flags.Endpoint, flags.WaitForEndpoint)
+}
+
 // mount -a seems to run goofys without PATH
 // usually fusermount is in /bin
 func EnsurePathIsSet() {
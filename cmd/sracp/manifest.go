@@ -0,0 +1,147 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mitre/fusera/awsutil"
+	"github.com/pkg/errors"
+)
+
+// manifest is a record of what a run copied, one entry per file.
+type manifest struct {
+	Files []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Acc  string `json:"accession"`
+	File string `json:"file"`
+	Path string `json:"path,omitempty"`
+	Size int64  `json:"size"`
+	Md5  string `json:"md5,omitempty"`
+	// Host and Region are where the file was served from, the region in
+	// the [service].[region] form of awsutil.InferRegion.
+	Host   string `json:"host,omitempty"`
+	Region string `json:"region,omitempty"`
+	// Status is empty or "ok" for a file that was copied, otherwise
+	// "failed", or "skipped" for one left out by --only or its size.
+	Status string `json:"status,omitempty"`
+}
+
+func (e manifestEntry) copied() bool {
+	return e.Status == "" || e.Status == "ok"
+}
+
+func readManifest(path string) (*manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read manifest %s", path)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse manifest %s", path)
+	}
+	return &m, nil
+}
+
+// newManifest records the outcome of every file a run wanted and every one
+// it skipped. A copied file has the size it has on disk, and when the API
+// didn't give its md5 it's taken from the job in copied, by path, that
+// worked it out while downloading, or else worked out; the rest have what
+// the API said. Without onDisk the files went to --dest, and a copied one
+// has the size and md5 its upload came to instead, when this run did the
+// uploading. Each is given the host and region its job downloaded it
+// from, or that its link points at when this run didn't download it.
+func newManifest(wanted, skipped []wantedFile, failures []failure, copied map[string]*job, onDisk bool) *manifest {
+	failed := make(map[string]bool)
+	for _, f := range failures {
+		failed[f.Acc+"/"+f.File] = true
+	}
+	m := &manifest{Files: make([]manifestEntry, 0, len(wanted)+len(skipped))}
+	add := func(w wantedFile, status string) {
+		e := manifestEntry{Acc: w.acc, File: w.file.Name, Path: w.path, Md5: w.file.Md5Hash, Status: status}
+		e.Size, _ = w.file.ParsedSize()
+		e.Host, e.Region = awsutil.Host(w.file.Link), awsutil.InferRegion(w.file.Service, w.file.Link)
+		j := copied[w.path]
+		if j != nil {
+			e.Host, e.Region = j.host, j.region
+		}
+		switch {
+		case status != "ok":
+		case !onDisk:
+			if j != nil {
+				e.Size = j.bytes
+				if e.Md5 == "" {
+					e.Md5 = j.md5
+				}
+			}
+		default:
+			if fi, err := os.Stat(w.path); err == nil {
+				e.Size = fi.Size()
+			}
+			if e.Md5 == "" && j != nil {
+				e.Md5 = j.md5
+			}
+			if e.Md5 == "" {
+				e.Md5, _ = awsutil.FileMD5(w.path)
+			}
+		}
+		m.Files = append(m.Files, e)
+	}
+	for _, w := range wanted {
+		if failed[w.acc+"/"+w.file.Name] || failed[w.acc+"/"] {
+			add(w, "failed")
+		} else {
+			add(w, "ok")
+		}
+	}
+	for _, w := range skipped {
+		add(w, "skipped")
+	}
+	sort.Slice(m.Files, func(i, j int) bool {
+		if m.Files[i].Acc != m.Files[j].Acc {
+			return m.Files[i].Acc < m.Files[j].Acc
+		}
+		return m.Files[i].File < m.Files[j].File
+	})
+	return m
+}
+
+// write saves the manifest to path, as a TSV with a header when the name
+// ends in .tsv and as JSON, which readManifest reads back, otherwise.
+func (m *manifest) write(path string) error {
+	var data []byte
+	if strings.HasSuffix(strings.ToLower(path), ".tsv") {
+		var b bytes.Buffer
+		fmt.Fprintln(&b, "accession\tfile\tpath\tsize\tmd5\tstatus\thost\tregion")
+		for _, e := range m.Files {
+			fmt.Fprintf(&b, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", e.Acc, e.File, e.Path, e.Size, e.Md5, e.Status, e.Host, e.Region)
+		}
+		data = b.Bytes()
+	} else {
+		var err error
+		if data, err = json.MarshalIndent(m, "", "  "); err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(ioutil.WriteFile(path, data, 0644), "couldn't write manifest %s", path)
+}
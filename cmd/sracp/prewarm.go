@@ -0,0 +1,62 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/nr"
+)
+
+// prewarm resolves every accession fresh and stores the result in the
+// cache, so a run started shortly after doesn't wait on the API.
+func prewarm(flags *Flags) error {
+	if err := waitForEndpoint(flags); err != nil {
+		return err
+	}
+	accs, issues, err := nr.ResolveNames(flags.Endpoint, flags.Loc, flags.Ngc, flags.Acc)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if err != nil {
+		return err
+	}
+	cache := &nr.Cache{Dir: flags.CacheDir}
+	cached := 0
+	var earliest time.Time
+	for _, a := range accs {
+		exp := a.Expiration()
+		if nr.NeedsRefresh(exp) {
+			twig.Infof("not caching %s, its urls expire within the refresh margin of %s\n", a.ID, nr.RefreshMargin)
+			continue
+		}
+		if err := cache.Put(flags.Endpoint, flags.Loc, flags.Ngc, a); err != nil {
+			return err
+		}
+		cached++
+		if !exp.IsZero() && (earliest.IsZero() || exp.Before(earliest)) {
+			earliest = exp
+		}
+	}
+	fmt.Printf("cached %d of %d accessions in %s\n", cached, len(flags.Acc), flags.CacheDir)
+	if earliest.IsZero() {
+		fmt.Println("none of the cached urls expire")
+	} else {
+		fmt.Printf("earliest expiration: %s (in %s)\n", earliest.Format(time.RFC3339), time.Until(earliest).Round(time.Second))
+	}
+	return nil
+}
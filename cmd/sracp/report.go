@@ -0,0 +1,222 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+const (
+	failedListName  = "failed.txt"
+	failedFilesName = "failed-files.json"
+)
+
+// failure is something sracp didn't manage to copy. File is empty when
+// the accession as a whole failed.
+type failure struct {
+	Acc  string `json:"accession"`
+	File string `json:"file,omitempty"`
+	// Status is the Name Resolver API's status for an accession it
+	// wouldn't resolve, and 0 for every other failure.
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (f failure) String() string {
+	if f.File == "" {
+		return fmt.Sprintf("%s: %s", f.Acc, f.Reason)
+	}
+	return fmt.Sprintf("%s/%s: %s", f.Acc, f.File, f.Reason)
+}
+
+// unresolved says how many of failures, all from before anything was
+// copied, are accessions the API didn't resolve and how many are files of
+// resolved ones it gave nothing usable for.
+func unresolved(failures []failure) string {
+	accs := make(map[string]bool)
+	files := 0
+	for _, f := range failures {
+		if f.File == "" {
+			accs[f.Acc] = true
+		} else {
+			files++
+		}
+	}
+	switch {
+	case files == 0:
+		return fmt.Sprintf("%d accessions weren't resolved", len(accs))
+	case len(accs) == 0:
+		return fmt.Sprintf("%d files weren't resolved", files)
+	}
+	return fmt.Sprintf("%d accessions and %d files weren't resolved", len(accs), files)
+}
+
+// writeFailures leaves behind the accessions that failed in dir, as a list
+// that can be handed straight back to --acc-file, and optionally every
+// failure in detail. A run without failures clears out any stale lists.
+func writeFailures(dir string, failures []failure, detailed bool) error {
+	list := filepath.Join(dir, failedListName)
+	details := filepath.Join(dir, failedFilesName)
+	if len(failures) == 0 {
+		for _, p := range []string{list, details} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "couldn't remove stale %s", p)
+			}
+		}
+		return nil
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, f := range failures {
+		if !seen[f.Acc] {
+			seen[f.Acc] = true
+			ids = append(ids, f.Acc)
+		}
+	}
+	sort.Strings(ids)
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(id)
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(list, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write %s", list)
+	}
+	if !detailed {
+		return nil
+	}
+	data, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode failures")
+	}
+	if err := ioutil.WriteFile(details, data, 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write %s", details)
+	}
+	return nil
+}
+
+// writeErrorFile writes every failure to path, whether the failure is in
+// resolving an accession or in copying one of its files, as JSON when the
+// name ends in .json and as a TSV with a header otherwise. Unlike the lists
+// writeFailures leaves, it's written even when nothing failed, so that
+// an empty one shows the run went through.
+func writeErrorFile(path string, failures []failure) error {
+	sorted := append([]failure(nil), failures...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Acc != sorted[j].Acc {
+			return sorted[i].Acc < sorted[j].Acc
+		}
+		return sorted[i].File < sorted[j].File
+	})
+	var data []byte
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if sorted == nil {
+			sorted = []failure{}
+		}
+		var err error
+		if data, err = json.MarshalIndent(sorted, "", "  "); err != nil {
+			return errors.Wrap(err, "couldn't encode failures")
+		}
+	} else {
+		var b bytes.Buffer
+		fmt.Fprintln(&b, "accession\tfile\tstatus\treason")
+		for _, f := range sorted {
+			// a reason can hold anything the API or the network said
+			reason := strings.NewReplacer("\t", " ", "\n", " ").Replace(f.Reason)
+			fmt.Fprintf(&b, "%s\t%s\t%d\t%s\n", f.Acc, f.File, f.Status, reason)
+		}
+		data = b.Bytes()
+	}
+	return errors.Wrapf(ioutil.WriteFile(path, data, 0644), "couldn't write error file %s", path)
+}
+
+// readErrorFile reads back what writeErrorFile wrote to path.
+func readErrorFile(path string) ([]failure, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open error file at: %s", path)
+	}
+	var failures []failure
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		if err := json.Unmarshal(data, &failures); err != nil {
+			return nil, errors.Wrapf(err, "couldn't read error file %s", path)
+		}
+		return failures, nil
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if i == 0 || line == "" {
+			// the header
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 || fields[0] == "" {
+			return nil, errors.Errorf("line %d of error file %s isn't accession, file, status and reason", i+1, path)
+		}
+		status, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, errors.Errorf("line %d of error file %s has an invalid status: %s", i+1, path, fields[2])
+		}
+		failures = append(failures, failure{Acc: fields[0], File: fields[1], Status: status, Reason: fields[3]})
+	}
+	return failures, nil
+}
+
+// retrySet is which files of which accessions to copy again after
+// failures, nil for every file of an accession that failed as a whole.
+func retrySet(failures []failure) map[string]map[string]bool {
+	retry := make(map[string]map[string]bool)
+	for _, f := range failures {
+		files, seen := retry[f.Acc]
+		switch {
+		case f.File == "":
+			retry[f.Acc] = nil
+		case !seen:
+			retry[f.Acc] = map[string]bool{f.File: true}
+		case files != nil:
+			files[f.File] = true
+		}
+	}
+	return retry
+}
+
+// retrying reports whether file name of acc is to be copied, which all of
+// them are unless they're being retried and it isn't one that failed. An
+// accession given some other way than the error file keeps all its files.
+func (f *Flags) retrying(acc, name string) bool {
+	files, ok := f.Retry[acc]
+	return !ok || files == nil || files[name]
+}
+
+// dropRetried leaves in accs only the files flags is retrying.
+func dropRetried(flags *Flags, accs map[string]nr.Accession) {
+	for id, a := range accs {
+		for name := range a.Files {
+			if !flags.retrying(id, name) {
+				delete(a.Files, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sizeUnits are the suffixes parseSize understands. K, M, G and T and
+// their B forms count in thousands, the iB forms in 1024s.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1e3,
+	"KB":  1e3,
+	"M":   1e6,
+	"MB":  1e6,
+	"G":   1e9,
+	"GB":  1e9,
+	"T":   1e12,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseSize reads a human readable amount of bytes, like 512, 50MB, 1.5G
+// or 4KiB.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("couldn't read %q as a size, expected something like 512, 50MB or 4KiB", s)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, errors.Errorf("unknown unit in size %q, expected B, KB, MB, GB, TB or KiB, MiB, GiB, TiB", s)
+	}
+	return int64(n * unit), nil
+}
+
+// formatSize writes n bytes the way parseSize reads them, in thousands.
+func formatSize(n int64) string {
+	for _, unit := range []string{"TB", "GB", "MB", "KB"} {
+		if size := sizeUnits[unit]; float64(n) >= size {
+			return strconv.FormatFloat(float64(n)/size, 'f', 1, 64) + unit
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
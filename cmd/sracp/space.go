@@ -0,0 +1,92 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// freeSpace is how many bytes an unprivileged user can still write to the
+// filesystem holding path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// spaceNeeded adds up the sizes of the files jobs will download, less what
+// earlier runs already left of them to resume from, along with how many of
+// them the API gave no size for.
+func spaceNeeded(jobs []*job) (total int64, unknown int) {
+	for _, j := range jobs {
+		size, err := j.file.ParsedSize()
+		if err != nil {
+			unknown++
+			continue
+		}
+		if size -= partialSize(j); size > 0 {
+			total += size
+		}
+	}
+	return total, unknown
+}
+
+// partialSize is how much room what an earlier run left of j's download
+// takes up: its .part, or the file itself while aria2c's control file is
+// next to it. A split download's .part is made full size up front with
+// holes where the parts still to come go, so it's the blocks on disk that
+// count rather than the size.
+func partialSize(j *job) int64 {
+	fi, err := os.Stat(j.path + ".part")
+	if err != nil {
+		if _, aerr := os.Stat(j.path + ".aria2"); aerr != nil {
+			return 0
+		}
+		if fi, err = os.Stat(j.path); err != nil {
+			return 0
+		}
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Blocks*512 < fi.Size() {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
+
+// checkSpace fails when the files of jobs won't fit under path. Files of
+// unknown size can't be counted, so it may still pass when they won't, and
+// when the free space can't be found out it's assumed to be enough.
+func checkSpace(path string, jobs []*job) error {
+	need, unknown := spaceNeeded(jobs)
+	free, err := freeSpace(path)
+	if err != nil {
+		twig.Debugf("couldn't find out how much space is free on %s: %s", path, err)
+		return nil
+	}
+	if need <= free {
+		return nil
+	}
+	msg := fmt.Sprintf("not enough space on %s: the files need %s but only %s is free, %s short", path, formatSize(need), formatSize(free), formatSize(need-free))
+	if unknown > 0 {
+		msg += fmt.Sprintf(", not counting %d files of unknown size", unknown)
+	}
+	return errors.New(msg)
+}
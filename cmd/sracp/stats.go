@@ -0,0 +1,141 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+)
+
+// regionStat is what was transferred from one region.
+type regionStat struct {
+	bytes  int64
+	files  int
+	failed int
+	hosts  map[string]bool
+}
+
+// regionStats tallies bytes by the region they came from, so a run can be
+// reconciled against a cloud provider's egress bill. Those are billed
+// whether or not the file made it, so failed jobs are added too.
+type regionStats map[string]*regionStat
+
+func (s regionStats) add(j *job) {
+	r, ok := s[j.region]
+	if !ok {
+		r = &regionStat{hosts: make(map[string]bool)}
+		s[j.region] = r
+	}
+	// what the native downloaders measured counts every attempt, the
+	// others only leave what ended up at the path
+	if j.stats.BytesWritten > 0 {
+		r.bytes += j.stats.BytesWritten
+	} else {
+		r.bytes += j.bytes
+	}
+	if j.err != nil {
+		r.failed++
+	} else {
+		r.files++
+	}
+	r.hosts[j.host] = true
+}
+
+func (s regionStats) log() {
+	regions := make([]string, 0, len(s))
+	for r := range s {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		r := s[region]
+		hosts := make([]string, 0, len(r.hosts))
+		for h := range r.hosts {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		twig.Infof("region=%s bytes=%d files=%d failed=%d hosts=%s\n", region, r.bytes, r.files, r.failed, strings.Join(hosts, ","))
+	}
+}
+
+// summary counts what a run did, for the line printed as it ends. It can
+// be added to from any goroutine.
+type summary struct {
+	start time.Time
+
+	mu      sync.Mutex
+	copied  int
+	present int
+	bytes   int64
+	// over the network, as measured by the downloaders that do
+	transferred int64
+	resumes     int
+}
+
+func newSummary() *summary {
+	return &summary{start: time.Now()}
+}
+
+// copiedFile counts a job that finished without error.
+func (s *summary) copiedFile(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.copied++
+	s.bytes += j.bytes
+	s.transferred += j.stats.BytesWritten
+	s.resumes += j.stats.Retries
+}
+
+// alreadyThere counts a file left alone because an earlier run copied it.
+func (s *summary) alreadyThere() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.present++
+}
+
+// String is the verdict on a run over accs accessions with failures.
+func (s *summary) String(accs int, failures []failure) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failedAccs := make(map[string]bool)
+	failedFiles := 0
+	for _, f := range failures {
+		failedAccs[f.Acc] = true
+		if f.File != "" {
+			failedFiles++
+		}
+	}
+	elapsed := time.Since(s.start)
+	size := formatSize(s.bytes)
+	if s.transferred > 0 && elapsed >= time.Second {
+		size += fmt.Sprintf(", %s/s", formatSize(int64(float64(s.transferred)/elapsed.Seconds())))
+	}
+	line := fmt.Sprintf("done in %s: %d of %d accessions complete, %d files copied (%s)", elapsed.Round(time.Second), accs-len(failedAccs), accs, s.copied, size)
+	if s.resumes > 0 {
+		line += fmt.Sprintf(", %d downloads resumed after dropping", s.resumes)
+	}
+	if s.present > 0 {
+		line += fmt.Sprintf(", %d already there", s.present)
+	}
+	if failedFiles > 0 {
+		line += fmt.Sprintf(", %d files failed", failedFiles)
+	}
+	return line
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+// verifyOnly checks the files a run would copy against what's already
+// under the path, by size and, unless checksums are skipped, by md5,
+// without downloading anything. Every file is listed with how it fared,
+// and the error counts those missing or corrupt along with the accessions
+// and files that weren't resolved.
+func verifyOnly(w io.Writer, flags *Flags, accs map[string]nr.Accession, failures []failure) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCESSION\tFILE\tRESULT")
+	var ok, missing, corrupt, unchecked int
+	for _, a := range sortedAccessions(accs) {
+		for _, f := range a.SortedFiles() {
+			if !flags.wants(f) {
+				continue
+			}
+			path := flags.target(a.ID, f.Name)
+			checked, err := checkCopy(f, path, !flags.SkipChecksum)
+			result := "ok"
+			switch {
+			case os.IsNotExist(err):
+				missing++
+				result = "missing"
+			case err != nil:
+				corrupt++
+				result = err.Error()
+			case !checked:
+				unchecked++
+				result = "unchecked, no size or md5 to go by"
+			default:
+				ok++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", a.ID, f.Name, result)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d ok, %d missing, %d corrupt", ok, missing, corrupt)
+	if unchecked > 0 {
+		fmt.Fprintf(w, ", %d with nothing to check them by", unchecked)
+	}
+	fmt.Fprintln(w)
+	for _, f := range failures {
+		fmt.Fprintln(w, f)
+	}
+	bad := missing + corrupt
+	switch {
+	case len(failures) > 0:
+		return errors.Errorf("%d files failed verification and %s", bad, unresolved(failures))
+	case bad > 0:
+		return errors.Errorf("%d files failed verification", bad)
+	}
+	return nil
+}
+
+// checkCopy checks the file at path against f, by its md5 when the API
+// gave one and checksum is set, and by its size otherwise. The error
+// satisfies os.IsNotExist when there's nothing at path, and says what's
+// wrong with it otherwise. A file with neither to go by can't be told
+// apart from a bad one, and isn't checked.
+func checkCopy(f nr.File, path string, checksum bool) (checked bool, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, errors.New("not a regular file")
+	}
+	// aria2c writes in place at the full size
+	if _, err := os.Stat(path + ".aria2"); err == nil {
+		return false, errors.New("incomplete, aria2c hasn't finished it")
+	}
+	size, serr := f.ParsedSize()
+	if serr == nil && size != fi.Size() {
+		return false, errors.Errorf("corrupt, %d bytes of %d", fi.Size(), size)
+	}
+	if checksum && f.Md5Hash != "" {
+		got, err := awsutil.FileMD5(path)
+		if err != nil {
+			return false, errors.Wrap(err, "couldn't checksum it")
+		}
+		if !strings.EqualFold(got, f.Md5Hash) {
+			return false, errors.Errorf("corrupt, md5 %s instead of %s", got, f.Md5Hash)
+		}
+		return true, nil
+	}
+	return serr == nil, nil
+}
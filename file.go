@@ -20,7 +20,6 @@ import (
 	"io"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/mattrbianchi/twig"
 	"github.com/mitre/fusera/awsutil"
@@ -58,6 +57,9 @@ type FileHandle struct {
 	existingReadahead int
 	seqReadAmount     uint64
 	numOOORead        uint64 // number of out of order read
+
+	// concurrent ranged reads, when more than one connection per file is allowed
+	ranges *awsutil.RangeReader
 }
 
 const MAX_READAHEAD = uint32(100 * 1024 * 1024)
@@ -175,6 +177,19 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 
 	fs := fh.inode.fs
 
+	if fs.opt.ConnectionsPerFile > 1 {
+		if fh.ranges == nil {
+			fh.ranges = awsutil.NewRangeReader(fh.link, int64(fh.inode.Attributes.Size), fs.opt.ConnectionsPerFile)
+			fh.ranges.Renew = fh.renew
+		}
+		bytesRead, err = fh.ranges.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			twig.Debugf("ranged read error: %s", err.Error())
+			err = syscall.EIO
+		}
+		return
+	}
+
 	if fh.poolHandle == nil {
 		fh.poolHandle = fs.bufferPool
 	}
@@ -216,6 +231,9 @@ func (fh *FileHandle) Release() {
 	if fh.reader != nil {
 		fh.reader.Close()
 	}
+	if fh.ranges != nil {
+		fh.ranges.Close()
+	}
 
 	// write buffers
 	if fh.poolHandle != nil {
@@ -254,20 +272,9 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 	}
 
 	if fh.reader == nil {
-		sd, _ := time.ParseDuration("30s")
-		exp := fh.inode.Attributes.ExpirationDate
-		if !exp.IsZero() {
-			twig.Debugf("seems like we have a url that expires: %s", exp)
-			if time.Until(exp) < sd {
-				twig.Debug("url is expired")
-				// Time to hot swap urls!
-				link, err := newURL(fh.inode)
-				if err != nil {
-					// fh.inode.logFuse("< readFromStream error", 0, err)
-					return 0, syscall.EACCES
-				}
-				fh.inode.Link = link
-			}
+		link, err := fh.link()
+		if err != nil {
+			return 0, err
 		}
 
 		bytes := ""
@@ -275,7 +282,8 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 			bytes = fmt.Sprintf("bytes=%v-", offset)
 		}
 
-		resp, err := awsutil.GetObjectRange(fh.inode.Link, bytes)
+		client := &awsutil.Client{Renew: func(string, string) (string, error) { return fh.renew(link) }}
+		resp, _, err := client.GetFileRange(fh.inode.Acc, *fh.inode.Name, link, bytes)
 		if err != nil {
 			return 0, err
 		}
@@ -300,26 +308,68 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 	return
 }
 
-func newURL(inode *Inode) (string, error) {
+// link returns the url to read the file from, renewing it first if it's
+// about to expire. Ranged reads call it from several goroutines at once.
+func (fh *FileHandle) link() (string, error) {
+	inode := fh.inode
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+	exp := inode.Attributes.ExpirationDate
+	if nr.NeedsRefresh(exp) {
+		twig.Debugf("url expires soon: %s", exp)
+		return fh.renewLocked()
+	}
+	return inode.Link, nil
+}
+
+// renew swaps in a new url for the file whatever its expiration date says,
+// for when refused has been refused. Reads refused together would each
+// resolve the accession again one after another, so once the inode holds
+// a url other than refused, that's the one already renewed and it's
+// returned as it is.
+func (fh *FileHandle) renew(refused string) (string, error) {
+	fh.inode.mu.Lock()
+	defer fh.inode.mu.Unlock()
+	if fh.inode.Link != refused {
+		return fh.inode.Link, nil
+	}
+	return fh.renewLocked()
+}
+
+// LOCKS_REQUIRED(fh.inode.mu)
+func (fh *FileHandle) renewLocked() (string, error) {
+	inode := fh.inode
+	// Time to hot swap urls!
+	f, err := newURL(inode)
+	if err != nil {
+		// fh.inode.logFuse("< readFromStream error", 0, err)
+		twig.Debugf("%s", err)
+		return "", syscall.EACCES
+	}
+	inode.Link = f.Link
+	inode.Attributes.ExpirationDate = f.ExpirationDate
+	return inode.Link, nil
+}
+
+// newURL resolves the inode's accession again, returning the file with its
+// new signed url and when that one expires.
+func newURL(inode *Inode) (nr.File, error) {
 	errfmtstr := "\naccession: %s\nfile: %s\n"
-	payload, err := nr.ResolveNames(inode.fs.opt.ApiEndpoint, inode.fs.opt.Loc, inode.fs.opt.Ngc, map[string]bool{inode.Acc: true})
+	client := nr.NewClient(nr.WithEndpoint(inode.fs.opt.ApiEndpoint), nr.WithLocation(inode.fs.opt.Loc), nr.WithNgc(inode.fs.opt.Ngc))
+	acc, err := client.ResolveOne(inode.Acc)
 	if err != nil {
-		return "", errors.Wrapf(err, "issue contacting API while trying to renew signed url for:%s", errfmtstr, inode.Acc, inode.Name)
+		return nr.File{}, errors.Wrapf(err, "issue contacting API while trying to renew signed url for:"+errfmtstr, inode.Acc, *inode.Name)
 	}
 	twig.Debug("resolved a url")
-	for _, p := range payload {
-		for _, f := range p.Files {
-			if f.Name == *inode.Name {
-				twig.Debug("got a new link")
-				if f.Link == "" {
-					return "", errors.Errorf("API did not give new signed url for:%s", errfmtstr, inode.Acc, inode.Name)
-				}
-				return f.Link, nil
-			}
+	if f, ok := acc.Files[*inode.Name]; ok {
+		twig.Debug("got a new link")
+		if f.Link == "" {
+			return nr.File{}, errors.Errorf("API did not give new signed url for:"+errfmtstr, inode.Acc, *inode.Name)
 		}
+		return f, nil
 	}
 	twig.Debug("did not get a new link")
-	return "", errors.Errorf("couldn't get new signed url for:%s", errfmtstr, inode.Acc, inode.Name)
+	return nr.File{}, errors.Errorf("couldn't get new signed url for:"+errfmtstr, inode.Acc, *inode.Name)
 }
 
 func (fh *FileHandle) resetToKnownSize() {
@@ -22,7 +22,6 @@ import (
 	"net/http"
 	"os"
 	"runtime/debug"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -42,6 +41,8 @@ type Options struct {
 	Acc         map[string]bool
 	Loc         string
 	ApiEndpoint string
+	// Where resolved urls are cached between runs, if anywhere
+	CacheDir string
 	// SRR# has a map of file names that map to urls where the data is
 	Urls map[string]map[string]string
 
@@ -60,6 +61,8 @@ type Options struct {
 	// Tuning
 	StatCacheTTL time.Duration
 	TypeCacheTTL time.Duration
+	// How many ranged reads an open file may have in flight at once
+	ConnectionsPerFile int
 
 	// Debugging
 	Debug      bool
@@ -89,10 +92,34 @@ func Mount(ctx context.Context, opt *Options) (*Fusera, *fuse.MountedFileSystem,
 }
 
 func NewFusera(ctx context.Context, opt *Options) (*Fusera, error) {
-	accessions, err := nr.ResolveNames(opt.ApiEndpoint, opt.Loc, opt.Ngc, opt.Acc)
+	var accessions map[string]nr.Accession
+	var issues []nr.AccessionError
+	var err error
+	if opt.CacheDir != "" {
+		accessions, issues, err = nr.ResolveNamesCached(ctx, &nr.Cache{Dir: opt.CacheDir}, opt.ApiEndpoint, opt.Loc, opt.Ngc, opt.Acc)
+		if err != nil && len(accessions) > 0 {
+			// the cached accessions are still usable
+			fmt.Println(err.Error())
+			err = nil
+		}
+	} else {
+		accessions, issues, err = nr.ResolveNames(opt.ApiEndpoint, opt.Loc, opt.Ngc, opt.Acc)
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
 	if err != nil {
 		return nil, err
 	}
+	var regions []string
+	for _, a := range accessions {
+		for _, f := range a.Files {
+			regions = append(regions, awsutil.InferRegion(f.Service, f.Link))
+		}
+	}
+	if w := awsutil.LocationWarning(opt.Loc, regions); w != "" {
+		twig.Infof("%s\n", w)
+	}
 	fs := &Fusera{
 		accs:  accessions,
 		opt:   opt,
@@ -149,13 +176,13 @@ func NewFusera(ctx context.Context, opt *Options) (*Fusera, error) {
 			file := NewInode(fs, dir, awsutil.String(name), &fullFileName)
 			file.Link = f.Link
 			file.Acc = acc.ID
-			u, err := strconv.ParseUint(f.Size, 10, 64)
+			size, err := f.ParsedSize()
 			if err != nil {
-				twig.Debug("%s: %s: failed to set file size to %s, couldn't parse into a uint64", acc.ID, file.Name, f.Size)
-				u = 0
+				twig.Debugf("%s: %s: failed to set file size: %s", acc.ID, name, err)
+				size = 0
 			}
 			file.Attributes = InodeAttributes{
-				Size:           u,
+				Size:           uint64(size),
 				Mtime:          f.ModifiedDate,
 				ExpirationDate: f.ExpirationDate,
 			}
@@ -287,14 +314,12 @@ func (fs *Fusera) getInodeOrDie(id fuseops.InodeID) (inode *Inode) {
 func (fs *Fusera) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error) {
 	var total_space uint64
 	for _, a := range fs.accs {
-		for _, f := range a.Files {
-			s, err := strconv.ParseUint(f.Size, 10, 64)
-			if err != nil {
-				total_space = 1024 * 1024 * 1024
-				goto skip
-			}
-			total_space += s
+		s, err := a.TotalSize()
+		if err != nil {
+			total_space = 1024 * 1024 * 1024
+			goto skip
 		}
+		total_space += uint64(s)
 	}
 skip:
 	const BLOCK_SIZE = 4096
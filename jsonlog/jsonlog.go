@@ -0,0 +1,149 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsonlog rewrites what twig logs as one JSON object per line, for
+// log aggregators that can't make sense of free-form text, and sets how
+// much of it there is. Every package keeps logging through twig as it
+// always has, only the output changes.
+package jsonlog
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is a single line of the log.
+type Entry struct {
+	Level   string `json:"level"`
+	Time    string `json:"time,omitempty"`
+	Caller  string `json:"caller,omitempty"`
+	Message string `json:"message"`
+	// the first accession the message names, and the file of it when the
+	// message names one by its path
+	Accession string `json:"accession,omitempty"`
+	File      string `json:"file,omitempty"`
+}
+
+var (
+	accessionPattern = regexp.MustCompile(`\b[DES]R[APRSXZ][0-9]{6,}\b`)
+	// the name of a file within an accession's directory
+	filePattern = regexp.MustCompile(`\b[DES]R[APRSXZ][0-9]{6,}/([^\s/:,]+)`)
+)
+
+// Writer turns what twig writes into Entries written to an io.Writer.
+// twig makes one Write per message, header and all, which is what lets a
+// message spanning several lines stay a single Entry.
+type Writer struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New returns a Writer writing to out.
+func New(out io.Writer) *Writer {
+	return &Writer{out: out}
+}
+
+// Use sends twig's output to out as JSON from now on.
+func Use(out io.Writer) {
+	setOutput(New(out))
+}
+
+// SetFormat has twig's output written to out as text or json.
+func SetFormat(format string, out io.Writer) error {
+	switch format {
+	case "", "text":
+		setOutput(out)
+	case "json":
+		Use(out)
+	default:
+		return errors.Errorf("log-format must be text or json, got: %s", format)
+	}
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	data, err := json.Marshal(parse(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// levels are the prefixes lines are logged with, by twig and Errorf.
+var levels = map[string]bool{"DEBUG": true, "INFO": true, "ERROR": true}
+
+// parse takes apart a line as twig writes it with any of the log flags,
+// such as "INFO 2018/01/02 15:04:05 main.go:12: message". A line that
+// doesn't start with a level, like one printed with fmt, is taken as info
+// and all of it is the message.
+func parse(line string) Entry {
+	e := Entry{Level: "info"}
+	line = strings.TrimRight(line, "\n")
+	if level, rest := cut(line); levels[level] {
+		e.Level, line = strings.ToLower(level), rest
+		var date, clock string
+		if len(line) >= 10 && line[4] == '/' && line[7] == '/' {
+			date, line = cut(line)
+		}
+		if len(line) >= 8 && line[2] == ':' && line[5] == ':' {
+			clock, line = cut(line)
+		}
+		if date != "" || clock != "" {
+			e.Time = timestamp(date, clock)
+		}
+		if i := strings.Index(line, ": "); i > 0 && strings.Contains(line[:i], ".go:") && !strings.Contains(line[:i], " ") {
+			e.Caller, line = line[:i], line[i+2:]
+		}
+	}
+	e.Message = line
+	e.Accession = accessionPattern.FindString(line)
+	if m := filePattern.FindStringSubmatch(line); m != nil {
+		e.File = m[1]
+	}
+	return e
+}
+
+func cut(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// timestamp is an RFC 3339 time from twig's date and time, either of which
+// may be missing. Without a date there's only the time of day to give.
+func timestamp(date, clock string) string {
+	if date == "" {
+		return clock
+	}
+	layout, value := "2006/01/02", date
+	if clock != "" {
+		layout, value = "2006/01/02 15:04:05.999999", date+" "+clock
+	}
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		return strings.TrimSpace(date + " " + clock)
+	}
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonlog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// Level is how much is logged.
+type Level int
+
+const (
+	// Errors logs only what's passed to Errorf, dropping all of twig's output.
+	Errors Level = iota
+	// Info adds twig's info messages, which is how fusera has always logged.
+	Info
+	// Debug adds twig's debug messages too.
+	Debug
+)
+
+var (
+	mu    sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = Info
+	// twig has no level for errors, so they have a logger of their own
+	// sharing its output and flags
+	errLog = log.New(os.Stderr, "ERROR ", twig.Flags())
+)
+
+// Verbosity is the Level asked for by --quiet, --verbose and debug, which
+// is either of -vv and --debug. verbose on its own is the default, Info.
+func Verbosity(quiet, verbose, debug bool) (Level, error) {
+	switch {
+	case quiet && (verbose || debug):
+		return Errors, errors.New("quiet can't be used along with verbose or debug")
+	case quiet:
+		return Errors, nil
+	case debug:
+		return Debug, nil
+	}
+	return Info, nil
+}
+
+// SetVerbosity sets the Level that Verbosity gives for its flags.
+func SetVerbosity(quiet, verbose, debug bool) error {
+	l, err := Verbosity(quiet, verbose, debug)
+	if err != nil {
+		return err
+	}
+	SetLevel(l)
+	return nil
+}
+
+// SetLevel logs as much as l from now on, along with the flags of twig's
+// header that suit it: the caller of a message only once there's more than
+// errors, and the time to the microsecond for debugging. Debug turns on
+// twig's debug output, the others leave it as it was.
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+	switch l {
+	case Errors:
+		twig.SetFlags(twig.LstdFlags)
+	case Info:
+		twig.SetFlags(twig.LstdFlags | twig.Lshortfile)
+	case Debug:
+		twig.SetFlags(twig.LstdFlags | twig.Lmicroseconds | twig.Lshortfile)
+		twig.SetDebug(true)
+	}
+	errLog.SetFlags(twig.Flags())
+	apply()
+}
+
+// Errorf logs an error, which is shown at every Level.
+func Errorf(format string, v ...interface{}) {
+	errLog.Output(2, fmt.Sprintf(format, v...))
+}
+
+func setOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+	apply()
+}
+
+// LOCKS_REQUIRED(mu)
+func apply() {
+	errLog.SetOutput(out)
+	if level == Errors {
+		twig.SetOutput(ioutil.Discard)
+		return
+	}
+	twig.SetOutput(out)
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nr
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParsePrefixes splits a comma separated list of accession prefixes,
+// such as "SRR,ERR", dropping empty entries.
+func ParsePrefixes(list string) []string {
+	var prefixes []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.ToUpper(strings.TrimSpace(p))
+		if p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes
+}
+
+// CheckPrefixes makes sure every accession starts with one of prefixes,
+// naming all those that don't. An empty list allows any accession.
+func CheckPrefixes(accs map[string]bool, prefixes []string) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var rejected []string
+	for acc := range accs {
+		if !hasPrefix(acc, prefixes) {
+			rejected = append(rejected, acc)
+		}
+	}
+	if len(rejected) == 0 {
+		return nil
+	}
+	sort.Strings(rejected)
+	return errors.Errorf("only accessions starting with %s are allowed, refusing: %s", strings.Join(prefixes, ", "), strings.Join(rejected, ", "))
+}
+
+func hasPrefix(acc string, prefixes []string) bool {
+	acc = strings.ToUpper(acc)
+	for _, p := range prefixes {
+		if strings.HasPrefix(acc, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAccessionList reads the accessions out of an accession file, which
+// is either a list, such as the SRR_Acc_List.txt the SRA Run Selector
+// exports, or a CSV table with a Run column, like its SraRunTable.csv.
+// Which one it is gets worked out from the header, and any other columns
+// of a table are ignored.
+// A list has accessions separated by newlines, commas or spaces. Anything
+// after a # is a comment, and blank lines are skipped. A line holding
+// something that isn't an accession is an error naming the line, as is
+// a malformed row of a table.
+// Each accession is only returned once.
+func ParseAccessionList(data []byte) ([]string, error) {
+	accs, ok, err := parseRunTable(data)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if accs, err = parseList(data); err != nil {
+			return nil, err
+		}
+	}
+	seen := make(map[string]bool, len(accs))
+	unique := accs[:0]
+	for _, a := range accs {
+		if !seen[a] {
+			seen[a] = true
+			unique = append(unique, a)
+		}
+	}
+	return unique, nil
+}
+
+// parseList reads the accessions of a plain accession list.
+func parseList(data []byte) ([]string, error) {
+	var accs []string
+	// lists saved on windows end their lines in \r\n, which TrimSpace handles
+	for i, line := range strings.Split(string(data), "\n") {
+		if c := strings.Index(line, "#"); c >= 0 {
+			line = line[:c]
+		}
+		for _, a := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		}) {
+			// a list can start with the name of its column
+			if i == 0 && len(accs) == 0 && strings.EqualFold(a, "Run") {
+				continue
+			}
+			if !isAccession(a) {
+				return nil, errors.Errorf("line %d of accession list: not an accession: %q", i+1, a)
+			}
+			accs = append(accs, a)
+		}
+	}
+	return accs, nil
+}
+
+// isAccession reports whether a looks like an accession: letters then
+// digits, such as SRR000001, optionally with a .version.
+func isAccession(a string) bool {
+	i := 0
+	for i < len(a) && (a[i] >= 'A' && a[i] <= 'Z' || a[i] >= 'a' && a[i] <= 'z') {
+		i++
+	}
+	if i == 0 || i == len(a) {
+		return false
+	}
+	digits := 0
+	for ; i < len(a); i++ {
+		switch {
+		case a[i] >= '0' && a[i] <= '9':
+			digits++
+		case a[i] == '.' && digits > 0 && i < len(a)-1:
+			digits = 0
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// parseRunTable returns the Run column of data if it's a CSV table that
+// has one. A row past the header that can't be read is an error, since
+// what follows it would be lost and a truncated table copied as though
+// it were the whole of it.
+func parseRunTable(data []byte) ([]string, bool, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil || len(header) < 2 {
+		return nil, false, nil
+	}
+	col := -1
+	for i, h := range header {
+		// the first header can carry a byte order mark
+		if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")), "Run") {
+			col = i
+			break
+		}
+	}
+	if col < 0 {
+		return nil, false, nil
+	}
+	var accs []string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if pe, ok := err.(*csv.ParseError); ok {
+				return nil, true, errors.Errorf("line %d of run table: %s", pe.StartLine, pe.Err)
+			}
+			return nil, true, errors.Wrap(err, "couldn't read run table")
+		}
+		if col < len(record) {
+			if a := strings.TrimSpace(record[col]); a != "" {
+				accs = append(accs, a)
+			}
+		}
+	}
+	return accs, true, nil
+}
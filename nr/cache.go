@@ -0,0 +1,147 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/pkg/errors"
+)
+
+// Links without an expiration date are still only trusted for this long
+// after they were cached, in case the data behind them moves.
+const cacheMaxAge = 24 * time.Hour
+
+// Cache keeps resolved accessions on disk so a later run can skip the
+// Name Resolver API. An entry is only served until its earliest link is
+// within RefreshMargin of expiring.
+type Cache struct {
+	Dir string
+}
+
+type cacheEntry struct {
+	Accession Accession `json:"accession"`
+	Cached    time.Time `json:"cached"`
+}
+
+// DefaultCacheDir is where the cache lives when the user doesn't choose.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "fusera")
+}
+
+// Entries are keyed by everything that can change the answer from the API,
+// so a different ngc file or location never sees another's signed urls.
+func (c *Cache) path(url, loc string, ngc []byte, acc string) string {
+	if url == "" {
+		url = DefaultEndpoint
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", url, loc, acc)
+	if Version != DefaultVersion {
+		fmt.Fprintf(h, "%s\x00", Version)
+	}
+	if len(PreferredServices) > 0 {
+		// which of a file's services was kept
+		fmt.Fprintf(h, "%s\x00", strings.Join(PreferredServices, ","))
+	}
+	h.Write(ngc)
+	return filepath.Join(c.Dir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+// Get returns the cached accession if there is one that hasn't expired.
+func (c *Cache) Get(url, loc string, ngc []byte, acc string) (Accession, bool) {
+	data, err := ioutil.ReadFile(c.path(url, loc, ngc, acc))
+	if err != nil {
+		return Accession{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		twig.Debugf("ignoring unreadable cache entry for %s: %s", acc, err)
+		return Accession{}, false
+	}
+	if !entry.valid(time.Now()) {
+		twig.Debugf("cache entry for %s has expired", acc)
+		return Accession{}, false
+	}
+	return entry.Accession, true
+}
+
+// Put stores acc in the cache. Accessions whose links have already
+// expired are not stored.
+func (c *Cache) Put(url, loc string, ngc []byte, acc Accession) error {
+	entry := cacheEntry{Accession: acc, Cached: time.Now()}
+	if !entry.valid(entry.Cached) {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return errors.Wrapf(err, "couldn't create cache directory: %s", c.Dir)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't encode cache entry for %s", acc.ID)
+	}
+	// Signed urls are credentials, keep them private to the user.
+	if err := ioutil.WriteFile(c.path(url, loc, ngc, acc.ID), data, 0600); err != nil {
+		return errors.Wrapf(err, "couldn't write cache entry for %s", acc.ID)
+	}
+	return nil
+}
+
+func (e cacheEntry) valid(now time.Time) bool {
+	if now.Sub(e.Cached) > cacheMaxAge {
+		return false
+	}
+	exp := e.Accession.Expiration()
+	return exp.IsZero() || now.Add(RefreshMargin).Before(exp)
+}
+
+// ResolveNamesCached behaves like ResolveNamesContext but answers what it
+// can from cache and stores whatever it had to resolve. When resolving
+// the rest fails, the accessions found in cache are returned with the error.
+func ResolveNamesCached(ctx context.Context, cache *Cache, url, loc string, ngc []byte, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	hits := make(map[string]Accession)
+	misses := make(map[string]bool)
+	for acc := range accs {
+		if a, ok := cache.Get(url, loc, ngc, acc); ok {
+			hits[acc] = a
+			continue
+		}
+		misses[acc] = true
+	}
+	twig.Debugf("cache hits: %d, misses: %d", len(hits), len(misses))
+	if len(misses) == 0 {
+		return hits, nil, nil
+	}
+	resolved, issues, err := ResolveNamesContext(ctx, url, loc, ngc, misses)
+	for id, a := range resolved {
+		if err := cache.Put(url, loc, ngc, a); err != nil {
+			twig.Debugf("%s", err)
+		}
+		hits[id] = a
+	}
+	return hits, issues, err
+}
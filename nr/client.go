@@ -0,0 +1,407 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/resilient"
+	"github.com/pkg/errors"
+)
+
+// DefaultVersion is the version of the API's protocol fusera was written
+// against.
+const DefaultVersion = "xc-1.0"
+
+// Version is the version of the API's protocol asked for unless
+// WithVersion says otherwise, so a newer one can be tried without a
+// rebuild.
+var Version = DefaultVersion
+
+// Client resolves accessions against one Name Resolver API with one set
+// of credentials. Create one with NewClient.
+type Client struct {
+	endpoint string
+	loc      string
+	ngc      []byte
+	version  string
+	format   string
+	agent    string
+	http     *http.Client
+	backoff  resilient.Backoff
+}
+
+// UserAgent identifies fusera to the API unless WithUserAgent says
+// otherwise, set by each command to include its version.
+var UserAgent = "fusera"
+
+// An Option configures a Client.
+type Option func(*Client)
+
+// WithEndpoint sets the url of the API, DefaultEndpoint when empty.
+func WithEndpoint(url string) Option {
+	return func(c *Client) {
+		c.endpoint = url
+	}
+}
+
+// WithLocation sets the region the API is asked to give links for.
+func WithLocation(loc string) Option {
+	return func(c *Client) {
+		c.loc = loc
+	}
+}
+
+// WithNgc sets the contents of the ngc file authorizing access to
+// controlled accessions. The Client holds on to ngc, it isn't copied.
+func WithNgc(ngc []byte) Option {
+	return func(c *Client) {
+		c.ngc = ngc
+	}
+}
+
+// WithVersion overrides the version field sent with every request.
+func WithVersion(version string) Option {
+	return func(c *Client) {
+		c.version = version
+	}
+}
+
+// DefaultFormat is the format responses are asked for in, the only one
+// Resolve can parse.
+const DefaultFormat = "json"
+
+// WithFormat has responses asked for in format, such as xml, for
+// ResolveRaw to pass through. Resolve and the rest only take json.
+func WithFormat(format string) Option {
+	return func(c *Client) {
+		c.format = format
+	}
+}
+
+// WithUserAgent overrides the User-Agent sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) {
+		c.agent = ua
+	}
+}
+
+// WithHTTPClient has requests made with hc instead of the package's own
+// client, which carries the certificate pins and the shared retry policy.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithBackoff sets the longest wait before the first retry of a request
+// and the most any wait grows to, zero for either leaving the default.
+func WithBackoff(base, limit time.Duration) Option {
+	return func(c *Client) {
+		c.backoff = resilient.Backoff{Base: base, Cap: limit}
+	}
+}
+
+// NewClient returns a Client for DefaultEndpoint configured by opts.
+func NewClient(opts ...Option) *Client {
+	c := &Client{endpoint: DefaultEndpoint, version: Version, format: DefaultFormat, agent: UserAgent}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.endpoint == "" {
+		twig.Debugf("Name Resolver endpoint was empty, using default: %s", DefaultEndpoint)
+		c.endpoint = DefaultEndpoint
+	}
+	if c.version == "" {
+		c.version = DefaultVersion
+	}
+	if c.agent == "" {
+		c.agent = UserAgent
+	}
+	if c.format == "" {
+		c.format = DefaultFormat
+	}
+	return c
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.http != nil {
+		return c.http
+	}
+	return client
+}
+
+// Resolve asks the API for the files of accs, see ResolveNames.
+func (c *Client) Resolve(accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	return c.ResolveContext(context.Background(), accs)
+}
+
+// ResolveContext is Resolve bounded by ctx. When ctx has a deadline the
+// accessions are resolved BatchSize at a time, so that if it passes, or a
+// batch fails, the accessions resolved up to then are returned along with
+// the error and can still be used.
+func (c *Client) ResolveContext(ctx context.Context, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	if _, ok := ctx.Deadline(); !ok || len(accs) <= BatchSize {
+		return c.resolve(ctx, accs)
+	}
+	ids := make([]string, 0, len(accs))
+	for acc := range accs {
+		ids = append(ids, acc)
+	}
+	sort.Strings(ids)
+	resolved := make(map[string]Accession)
+	var issues []AccessionError
+	for start := 0; start < len(ids); start += BatchSize {
+		end := start + BatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := make(map[string]bool, end-start)
+		for _, acc := range ids[start:end] {
+			batch[acc] = true
+		}
+		res, batchIssues, err := c.resolve(ctx, batch)
+		issues = append(issues, batchIssues...)
+		if _, ok := err.(*NoAccessionsError); ok {
+			// a batch the API resolved nothing of is no reason to stop
+			continue
+		}
+		if err != nil {
+			return resolved, issues, errors.Wrapf(err, "resolved %d of %d accessions before stopping", len(resolved), len(accs))
+		}
+		for id, a := range res {
+			resolved[id] = a
+		}
+	}
+	if len(resolved) == 0 {
+		return resolved, issues, &NoAccessionsError{Issues: issues}
+	}
+	return resolved, issues, nil
+}
+
+// ResolveOne asks the API about acc alone, such as to renew the links of
+// its files. When the API wouldn't resolve it, the error is the
+// AccessionError it reported.
+func (c *Client) ResolveOne(acc string) (Accession, error) {
+	return c.ResolveOneContext(context.Background(), acc)
+}
+
+// ResolveOneContext is ResolveOne bounded by ctx.
+func (c *Client) ResolveOneContext(ctx context.Context, acc string) (Accession, error) {
+	accs, issues, err := c.resolve(ctx, map[string]bool{acc: true})
+	if a, ok := accs[acc]; ok {
+		return a, nil
+	}
+	for _, issue := range issues {
+		if issue.ID == acc && issue.File == "" {
+			return Accession{}, issue
+		}
+	}
+	if err != nil {
+		return Accession{}, err
+	}
+	return Accession{}, errors.Errorf("API didn't return accession %s", acc)
+}
+
+// ResolveReader is Resolve with the ngc file read from ngc rather than the
+// one the Client was made with, streamed straight into the request and
+// never held in memory whole. Since it can only be read once, all of accs
+// are asked about in one request, which isn't retried.
+func (c *Client) ResolveReader(ngc io.Reader, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	return c.resolveWith(context.Background(), ngc, true, accs)
+}
+
+func (c *Client) resolve(ctx context.Context, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	var ngc io.Reader
+	if c.ngc != nil {
+		ngc = bytes.NewReader(c.ngc)
+	}
+	return c.resolveWith(ctx, ngc, false, accs)
+}
+
+// ResolveRaw makes a single request about accs, like ResolveReader does
+// but with the Client's ngc, and returns the body of the response as it
+// came, decompressed, along with its Content-Type. Nothing is checked but
+// the status, so the format the Client asks for can be anything the API
+// gives.
+func (c *Client) ResolveRaw(ctx context.Context, accs map[string]bool) ([]byte, string, error) {
+	var ngc io.Reader
+	if c.ngc != nil {
+		ngc = bytes.NewReader(c.ngc)
+	}
+	resp, err := c.post(ctx, ngc, false, c.format, accs)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "couldn't read response from Name Resolver API")
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// post sends the request about accs, asking for format, and returns the
+// response once it's come back with a 200. With stream, the form is
+// written as it's sent rather than built first, and can't be retried.
+func (c *Client) post(ctx context.Context, ngc io.Reader, stream bool, format string, accs map[string]bool) (*http.Response, error) {
+	var body io.Reader
+	var contentType string
+	var written <-chan error
+	if stream {
+		pr, ct, done, err := streamBody(c.version, format, c.loc, ngc, accs)
+		if err != nil {
+			return nil, err
+		}
+		// whatever happens to the request, the form stops being written
+		defer pr.Close()
+		body, contentType, written = pr, ct, done
+	} else {
+		buf, ct, err := requestBody(c.version, format, c.loc, ngc, accs)
+		if err != nil {
+			return nil, err
+		}
+		body, contentType = buf, ct
+	}
+	twig.Debugf("version: %s", c.version)
+	twig.Debugf("format: %s", format)
+	twig.Debugf("location: %s", c.loc)
+	twig.Debugf("acc: %v", accs)
+
+	req, err := http.NewRequest("POST", c.endpoint, body)
+	if err != nil {
+		return nil, errors.New("can't create request to Name Resolver API")
+	}
+	req = req.WithContext(resilient.WithPolicy(ctx, resolvePolicy(c.backoff)))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", c.agent)
+	// asked for explicitly so deflate is offered too, which means the
+	// body has to be decoded here rather than by net/http
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	twig.Debugf("HTTP REQUEST:\n %+v", req)
+	resp, err := c.httpClient().Do(req)
+	if err != nil && written != nil {
+		// the request most likely failed for want of the form
+		req.Body.Close()
+		if werr := <-written; werr != nil && werr != io.ErrClosedPipe {
+			return nil, werr
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), "gave up resolving acc names")
+		}
+		return nil, errors.Wrap(err, "can't resolve acc names")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("encountered error from Name Resolver API: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// resolveWith makes a single request about accs. Unless stream is set the
+// form is built in memory so the request can be sent again by a retry.
+func (c *Client) resolveWith(ctx context.Context, ngc io.Reader, stream bool, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	if c.format != DefaultFormat {
+		return nil, nil, errors.Errorf("can only make sense of %s from the Name Resolver API, not %s, ResolveRaw passes that through", DefaultFormat, c.format)
+	}
+	resp, err := c.post(ctx, ngc, stream, DefaultFormat, accs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	ct := resp.Header.Get("Content-Type")
+	if ct != "application/json" {
+		// most likely a login or error page of a proxy in the way
+		if body, err := readBody(resp); err == nil && len(body) > 0 {
+			return nil, nil, errors.Errorf("Name Resolver API gave incorrect Content-Type: %s, the response began: %s", ct, snippet(body))
+		}
+		return nil, nil, errors.Errorf("Name Resolver API gave incorrect Content-Type: %s", ct)
+	}
+
+	bytes, err := readBody(resp)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fatal error when trying to read response from Name Resolver API")
+	}
+	content := string(bytes)
+	twig.Debugf("Response Body from API:\n%s", content)
+	switch trimmed := strings.TrimSpace(content); {
+	case trimmed == "":
+		return nil, nil, errors.New("Name Resolver API gave an empty response")
+	case trimmed[0] != '[' && trimmed[0] != '{':
+		return nil, nil, errors.Errorf("Name Resolver API didn't answer with JSON, the response began: %s", snippet(bytes))
+	}
+	var payload []Payload
+	err = json.Unmarshal(bytes, &payload)
+	if err != nil {
+		var errPayload Payload
+		if perr := json.Unmarshal(bytes, &errPayload); perr != nil {
+			// not shown, it could well hold signed links
+			return nil, nil, errors.Errorf("fatal error when trying to read response from Name Resolver API, its %d bytes aren't valid JSON: %s", len(bytes), err)
+		}
+		return nil, nil, errors.Errorf("encountered error from Name Resolver API: %d: %s", errPayload.Status, errPayload.Message)
+	}
+
+	return sanitize(payload)
+}
+
+// snippetLength is how much of a response an error shows.
+const snippetLength = 200
+
+// snippet is the start of body on a single line, for an error to show
+// what came back instead of what was expected.
+func snippet(body []byte) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if r := []rune(s); len(r) > snippetLength {
+		s = string(r[:snippetLength]) + "..."
+	}
+	return s
+}
+
+// readBody reads all of resp's body, decompressing it when its
+// Content-Encoding is gzip or deflate.
+func readBody(resp *http.Response) ([]byte, error) {
+	var r io.Reader = resp.Body
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decompress gzip response")
+		}
+		defer zr.Close()
+		r = zr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't decompress deflate response")
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, errors.Errorf("response has an unsupported Content-Encoding: %s", resp.Header.Get("Content-Encoding"))
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,66 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nr
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/resilient"
+	"github.com/pkg/errors"
+)
+
+// Ping checks that the Name Resolver API at url is up. Any answer short of
+// a server error will do, the request itself isn't a valid query.
+func Ping(url string) error {
+	if url == "" {
+		url = DefaultEndpoint
+	}
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "can't create request to Name Resolver API at %s", url)
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	// a single try, WaitForEndpoint does its own retrying
+	ping := &http.Client{Transport: base, Timeout: 10 * time.Second}
+	resp, err := ping.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't reach Name Resolver API at %s", url)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("Name Resolver API at %s isn't healthy: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// WaitForEndpoint pings the Name Resolver API until it's up, backing off
+// between attempts, and gives up once timeout has passed. This covers jobs
+// that start before the network on a fresh machine is ready.
+func WaitForEndpoint(url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	b := resilient.Backoff{Base: time.Second, Cap: 30 * time.Second}
+	for try := 1; ; try++ {
+		err := Ping(url)
+		if err == nil {
+			return nil
+		}
+		wait := b.Next(try)
+		if time.Now().Add(wait).After(deadline) {
+			return errors.Wrapf(err, "gave up after waiting %s for the Name Resolver API", timeout)
+		}
+		twig.Debugf("%s, trying again in %s", err, wait)
+		time.Sleep(wait)
+	}
+}
@@ -14,115 +14,216 @@ package nr
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/resilient"
 	"github.com/pkg/errors"
 )
 
-func ResolveNames(url, loc string, ngc []byte, accs map[string]bool) (map[string]Accession, error) {
-	if url == "" {
-		url = "https://www.ncbi.nlm.nih.gov/Traces/names/names.fcgi"
-		twig.Debugf("Name Resolver endpoint was empty, using default: %s", url)
+// DefaultEndpoint is the Name Resolver API used when none is given.
+const DefaultEndpoint = "https://www.ncbi.nlm.nih.gov/Traces/names/names.fcgi"
+
+// CheckEndpoint makes sure endpoint is an absolute http or https url, as
+// the Name Resolver API has to be. Empty is fine, it means DefaultEndpoint.
+func CheckEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "Name Resolver endpoint isn't a valid url: %s", endpoint)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("Name Resolver endpoint must be an absolute http or https url, like %s: %s", DefaultEndpoint, endpoint)
+	}
+	return nil
+}
+
+// RefreshMargin is how long before a link expires that it's treated as
+// expired, so that it's renewed before a transfer using it can fail partway.
+// Every check of a link's expiration goes through NeedsRefresh.
+var RefreshMargin = 5 * time.Minute
+
+// NeedsRefresh reports whether a link expiring at exp should be resolved
+// again before it's used. A zero exp never expires.
+func NeedsRefresh(exp time.Time) bool {
+	return !exp.IsZero() && time.Until(exp) < RefreshMargin
+}
+
+// MaxRetries is how many more times a request to the Name Resolver API is
+// made after a network error or a 5xx or 429 response, waiting up to 1s,
+// 2s, 4s and so on in between, unless WithBackoff says otherwise. Any
+// other response is final.
+var MaxRetries = 3
+
+// resolvePolicy is the shared policy with the resolver's own retries and
+// backoff, keeping the circuit breaking and Retry-After handling. A zero
+// field of b leaves the package's own.
+func resolvePolicy(b resilient.Backoff) resilient.Policy {
+	p := resilient.Default.Policy()
+	p.Retries = MaxRetries
+	p.MinBackoff = time.Second
+	if b.Base > 0 {
+		p.MinBackoff = b.Base
+	}
+	if b.Cap > 0 {
+		p.MaxBackoff = b.Cap
+	}
+	return p
+}
+
+// WipeNgc overwrites the contents of an ngc file held in memory. The ngc is
+// read once when a run starts and the same bytes are given to every call
+// to ResolveNames, so this is called once the run is done with them.
+func WipeNgc(ngc []byte) {
+	for i := range ngc {
+		ngc[i] = 0
+	}
+}
+
+// ResolveNames asks the Name Resolver API for the files of accs. Along with
+// the accessions that resolved, it returns each problem the API reported
+// with an accession or one of its files, for the caller to show as it sees
+// fit. The error is for when nothing could be resolved at all.
+func ResolveNames(url, loc string, ngc []byte, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	return ResolveNamesContext(context.Background(), url, loc, ngc, accs)
+}
+
+// BatchSize is how many accessions are asked about per request when
+// resolving against a deadline.
+var BatchSize = 100
+
+// ResolveNamesContext is ResolveNames bounded by ctx, see Client.ResolveContext.
+func ResolveNamesContext(ctx context.Context, url, loc string, ngc []byte, accs map[string]bool) (map[string]Accession, []AccessionError, error) {
+	return NewClient(WithEndpoint(url), WithLocation(loc), WithNgc(ngc)).ResolveContext(ctx, accs)
+}
+
+// requestBody builds the multipart form sent to the API in memory, so a
+// retry can send it again. When a field can't be written the error names
+// it and says how much of the body had been written, and whatever was
+// built is dropped.
+func requestBody(version, format, loc string, ngc io.Reader, accs map[string]bool) (*bytes.Buffer, string, error) {
+	if strings.TrimSpace(version) == "" {
+		return nil, "", errors.New("no version to send to Name Resolver API")
 	}
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
+	if err := writeForm(writer, version, format, loc, ngc, accs, func() int64 { return int64(body.Len()) }); err != nil {
+		// it may already hold the ngc
+		WipeNgc(body.Bytes())
+		body.Reset()
+		return nil, "", err
+	}
+	return body, writer.FormDataContentType(), nil
+}
+
+// streamBody is requestBody writing the form into the returned body as
+// the request reads it, so however big ngc is it's never held in memory
+// whole, but the body can only be sent once. What went wrong writing it
+// comes on the channel once the body has been read to the end or closed,
+// nil when nothing did.
+func streamBody(version, format, loc string, ngc io.Reader, accs map[string]bool) (io.ReadCloser, string, <-chan error, error) {
+	if strings.TrimSpace(version) == "" {
+		return nil, "", nil, errors.New("no version to send to Name Resolver API")
+	}
+	pr, pw := io.Pipe()
+	counted := &countingWriter{w: pw}
+	writer := multipart.NewWriter(counted)
+	done := make(chan error, 1)
+	go func() {
+		err := writeForm(writer, version, format, loc, ngc, accs, func() int64 { return counted.n })
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	return pr, writer.FormDataContentType(), done, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeForm writes the fields of the form to writer, closing it. written
+// is how many bytes of the body have been written, for an error to say.
+func writeForm(writer *multipart.Writer, version, format, loc string, ngc io.Reader, accs map[string]bool, written func() int64) error {
+	fail := func(err error, what string) error {
+		return errors.Wrapf(err, "couldn't write %s of request to Name Resolver API after %d bytes", what, written())
+	}
 	if ngc != nil {
-		// handle ngc bytes
 		part, err := writer.CreateFormFile("ngc", "ngc")
 		if err != nil {
-			return nil, errors.Wrapf(err, "couldn't create form file for ngc")
+			return fail(err, "ngc field")
 		}
-		_, err = io.Copy(part, bytes.NewReader(ngc))
+		// never put the contents in an error, they're credentials
+		n, err := io.Copy(part, ngc)
 		if err != nil {
-			return nil, errors.Errorf("couldn't copy ngc contents: %s into multipart file to make request", ngc)
+			return fail(err, "ngc field")
+		}
+		if n == 0 {
+			// the API's answer to an empty one doesn't say what's wrong
+			return errors.New("ngc file is empty, it should hold the credentials downloaded from dbGaP")
 		}
-
 	}
-	if err := writer.WriteField("version", "xc-1.0"); err != nil {
-		return nil, errors.New("could not write version field to multipart.Writer")
+	if err := writer.WriteField("version", version); err != nil {
+		return fail(err, "version field")
 	}
-	if err := writer.WriteField("format", "json"); err != nil {
-		return nil, errors.New("could not write format field to multipart.Writer")
+	if err := writer.WriteField("format", format); err != nil {
+		return fail(err, "format field")
 	}
 	if loc != "" {
 		if err := writer.WriteField("location", loc); err != nil {
-			return nil, errors.New("could not write loc field to multipart.Writer")
+			return fail(err, "location field")
 		}
 	}
-	if accs != nil {
-		for acc, _ := range accs {
-			if err := writer.WriteField("acc", acc); err != nil {
-				return nil, errors.New("could not write acc field to multipart.Writer")
-			}
+	for acc := range accs {
+		if err := writer.WriteField("acc", acc); err != nil {
+			return fail(err, "acc field for "+acc)
 		}
 	}
-	twig.Debug("version: xc-1.0")
-	twig.Debug("format: json")
-	twig.Debugf("location: %s", loc)
-	twig.Debugf("acc: %v", accs)
 	if err := writer.Close(); err != nil {
-		return nil, errors.New("could not close multipart.Writer")
-	}
-
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, errors.New("can't create request to Name Resolver API")
-	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	twig.Debugf("HTTP REQUEST:\n %+v", req)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, errors.New("can't resolve acc names")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("encountered error from Name Resolver API: %s", resp.Status)
-	}
-	ct := resp.Header.Get("Content-Type")
-	if ct != "application/json" {
-		return nil, errors.Errorf("Name Resolver API gave incorrect Content-Type: %s", ct)
-	}
-
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.New("fatal error when trying to read response from Name Resolver API")
-	}
-	content := string(bytes)
-	twig.Debugf("Response Body from API:\n%s", content)
-	var payload []Payload
-	err = json.Unmarshal(bytes, &payload)
-	if err != nil {
-		var errPayload Payload
-		err = json.Unmarshal(bytes, &errPayload)
-		if err != nil {
-			return nil, errors.New("fatal error when trying to read response from Name Resolver API")
-		}
-		return nil, errors.Errorf("encountered error from Name Resolver API: %d: %s", errPayload.Status, errPayload.Message)
+		return fail(err, "closing boundary")
 	}
+	return nil
+}
 
-	accessions, msg, err := sanitize(payload)
-	if msg != "" && err == nil {
-		fmt.Println(msg)
-	}
+// AccessionError is a problem the API reported with an accession, or that
+// was found with one of the files it gave for it.
+type AccessionError struct {
+	ID string
+	// File is empty when the whole accession failed.
+	File string
+	// Status is the API's status for the accession, 0 for a problem with a file.
+	Status  int
+	Message string
+}
 
-	return accessions, err
+func (e AccessionError) Error() string {
+	return fmt.Sprintf("issue with accession %s: %s", e.ID, e.Message)
 }
 
-// msg is used to develop a message to the user indicating which accessions did not succeed while keeping err useful for disastrous errors.
-func sanitize(payload []Payload) (accs map[string]Accession, msg string, err error) {
-	errmsg := ""
+// sanitize keeps what's usable of payload, returning an AccessionError for
+// everything that isn't, while keeping err for disastrous errors.
+func sanitize(payload []Payload) (accs map[string]Accession, issues []AccessionError, err error) {
 	accs = make(map[string]Accession)
 	for _, p := range payload {
 		if p.Status != http.StatusOK {
-			msg = msg + fmt.Sprintf("issue with accession %s: %s\n", p.ID, p.Message)
-			errmsg = errmsg + fmt.Sprintf("%s: %d\t%s", p.ID, p.Status, p.Message)
+			issues = append(issues, AccessionError{ID: p.ID, Status: p.Status, Message: p.Message})
 			continue
 		}
 		// get existing acc or make a new one
@@ -133,11 +234,31 @@ func sanitize(payload []Payload) (accs map[string]Accession, msg string, err err
 		}
 		for _, f := range p.Files {
 			if f.Link == "" {
-				msg = msg + fmt.Sprintf("issue with accession %s: API returned no link for %s\n", p.ID, f.Name)
+				issues = append(issues, AccessionError{ID: p.ID, File: f.Name, Message: "API returned no link for " + f.Name})
 				continue
 			}
 			if f.Name == "" {
-				msg = msg + fmt.Sprintf("issue with accession %s: API returned no name for %s\n", p.ID, f)
+				issues = append(issues, AccessionError{ID: p.ID, Message: fmt.Sprintf("API returned no name for %s", f)})
+				continue
+			}
+			link, err := normalizeLink(f.Link)
+			if err != nil {
+				issues = append(issues, AccessionError{ID: p.ID, File: f.Name, Message: (&LinkError{File: f.Name, Link: f.Link, Err: err}).Error()})
+				continue
+			}
+			f.Link = link
+			// The same name can come back more than once, say from different
+			// services. One entry is kept whole so its size and md5 always
+			// describe its own link, rather than mixing fields of several:
+			// the one from the service earliest in PreferredServices, and
+			// between those equally preferred the one returned first.
+			if prev, ok := acc.Files[f.Name]; ok {
+				keep, drop := prev, f
+				if servicePriority(f.Service) < servicePriority(prev.Service) {
+					keep, drop = f, prev
+				}
+				acc.Files[f.Name] = keep
+				issues = append(issues, AccessionError{ID: p.ID, File: f.Name, Message: duplicateMessage(keep, drop)})
 				continue
 			}
 			acc.Files[f.Name] = f
@@ -145,12 +266,145 @@ func sanitize(payload []Payload) (accs map[string]Accession, msg string, err err
 		// finally finished with acc
 		accs[acc.ID] = acc
 	}
+	// Every request with links already expired would be refused, so such
+	// accessions fail now rather than one file at a time.
+	ids := make([]string, 0, len(accs))
+	for id := range accs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	now := time.Now()
+	for _, id := range ids {
+		if last, ok := expiredBy(accs[id], now); ok {
+			delete(accs, id)
+			msg := fmt.Sprintf("links expired, re-resolve needed: all of them expired by %s", last.Format(time.RFC3339))
+			issues = append(issues, AccessionError{ID: id, Message: msg})
+		}
+	}
 	if len(accs) < 1 {
-		err = errors.Errorf("API returned no mountable accessions\n%s", errmsg)
+		err = &NoAccessionsError{Issues: issues}
 	}
 	return
 }
 
+// NoAccessionsError is the error when the API resolved none of the
+// accessions asked about. Issues are the same ones returned alongside it,
+// for whoever only has the error to go on; the message just counts them,
+// since a caller showing the issues would otherwise show each one twice.
+type NoAccessionsError struct {
+	Issues []AccessionError
+}
+
+func (e *NoAccessionsError) Error() string {
+	if len(e.Issues) == 0 {
+		return "API returned no mountable accessions"
+	}
+	return fmt.Sprintf("API returned no mountable accessions, with %d issues", len(e.Issues))
+}
+
+// expiredBy reports whether every link of a expired before now, along with
+// when the last of them did. An accession without files, or with a link
+// that doesn't expire, hasn't. This goes by the dates themselves rather
+// than NeedsRefresh, a link about to expire is still one to renew.
+func expiredBy(a Accession, now time.Time) (time.Time, bool) {
+	var last time.Time
+	for _, f := range a.Files {
+		if f.ExpirationDate.IsZero() || f.ExpirationDate.After(now) {
+			return time.Time{}, false
+		}
+		if f.ExpirationDate.After(last) {
+			last = f.ExpirationDate
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// LinkError is a link from the API that can't be used.
+type LinkError struct {
+	File string
+	Link string
+	Err  error
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("API returned an unusable link for %s: %s", e.File, e.Err)
+}
+
+// normalizeLink makes sure link is an absolute url of a scheme the data can
+// be fetched over, filling in https for a scheme-relative //host/path.
+func normalizeLink(link string) (string, error) {
+	link = strings.TrimSpace(link)
+	if strings.HasPrefix(link, "//") {
+		link = "https:" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		// the error repeats the link, which may be signed
+		return "", errors.New("not a url")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "gs", "s3":
+	case "":
+		return "", errors.New("no scheme, expected an absolute url")
+	default:
+		return "", errors.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", errors.New("no host")
+	}
+	return link, nil
+}
+
+// PreferredServices decides which of several entries the API returns for
+// the same file is used, by the service they're from, such as s3 or gs.
+// Earlier services are preferred, and any service not listed comes last.
+var PreferredServices []string
+
+// ParseServices splits a comma separated list of services, such as
+// "s3,gs", for PreferredServices.
+func ParseServices(list string) []string {
+	var services []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" {
+			services = append(services, s)
+		}
+	}
+	return services
+}
+
+func servicePriority(service string) int {
+	for i, s := range PreferredServices {
+		if strings.EqualFold(s, service) {
+			return i
+		}
+	}
+	return len(PreferredServices)
+}
+
+// duplicateMessage says which of two entries for a file was kept.
+func duplicateMessage(keep, drop File) string {
+	if !sameContent(keep, drop) {
+		return fmt.Sprintf("API returned conflicting entries for %s (size %s, md5 %s from %s; size %s, md5 %s from %s), using the one from %s", keep.Name, keep.Size, keep.Md5Hash, keep.Service, drop.Size, drop.Md5Hash, drop.Service, keep.Service)
+	}
+	if strings.EqualFold(keep.Service, drop.Service) {
+		return fmt.Sprintf("API returned %s more than once, using the first", keep.Name)
+	}
+	return fmt.Sprintf("API returned %s from both %s and %s, using the one from %s", keep.Name, keep.Service, drop.Service, keep.Service)
+}
+
+// sameContent reports whether two entries for a file agree on what is in it.
+// Fields the API left empty don't count as disagreeing.
+func sameContent(a, b File) bool {
+	if a.Size != "" && b.Size != "" && a.Size != b.Size {
+		return false
+	}
+	if a.Md5Hash != "" && b.Md5Hash != "" && !strings.EqualFold(a.Md5Hash, b.Md5Hash) {
+		return false
+	}
+	return true
+}
+
 type Payload struct {
 	ID      string `json:"accession,omitempty"`
 	Status  int    `json:"status,omitempty"`
@@ -163,6 +417,33 @@ type Accession struct {
 	Files map[string]File
 }
 
+// Expiration returns the earliest time any of the accession's links
+// expire, or the zero time if none of them do.
+func (a Accession) Expiration() time.Time {
+	var exp time.Time
+	for _, f := range a.Files {
+		if f.ExpirationDate.IsZero() {
+			continue
+		}
+		if exp.IsZero() || f.ExpirationDate.Before(exp) {
+			exp = f.ExpirationDate
+		}
+	}
+	return exp
+}
+
+// SortedFiles returns the accession's files ordered by name, for when
+// they're gone through one by one and the order should be the same every
+// time. Files is still there to look one up by name.
+func (a Accession) SortedFiles() []File {
+	files := make([]File, 0, len(a.Files))
+	for _, f := range a.Files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
 type File struct {
 	Name           string    `json:"name,omitempty"`
 	Size           string    `json:"size,omitempty"`
@@ -172,3 +453,30 @@ type File struct {
 	ExpirationDate time.Time `json:"expirationDate,omitempty"`
 	Service        string    `json:"service,omitempty"`
 }
+
+// ParsedSize is Size as a number of bytes. The API sends it as a string,
+// which can be missing or malformed.
+func (f File) ParsedSize() (int64, error) {
+	if f.Size == "" {
+		return 0, errors.Errorf("API gave no size for %s", f.Name)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(f.Size), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("API gave an invalid size for %s: %s", f.Name, f.Size)
+	}
+	return n, nil
+}
+
+// TotalSize is the sum of the sizes of the accession's files, failing on
+// the first one whose size isn't known.
+func (a Accession) TotalSize() (int64, error) {
+	var total int64
+	for _, f := range a.Files {
+		n, err := f.ParsedSize()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 The MITRE Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nr
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// failingReader gives data and then fails with err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestRequestBodyNgcReadFails(t *testing.T) {
+	secret := "partial ngc contents"
+	readErr := errors.New("disk went away")
+	body, contentType, err := requestBody(DefaultVersion, DefaultFormat, "s3.us-east-1", &failingReader{data: []byte(secret), err: readErr}, map[string]bool{"SRR000001": true})
+	if err == nil {
+		t.Fatal("expected an error from a failing ngc reader")
+	}
+	if body != nil || contentType != "" {
+		t.Errorf("expected no body or content type along with the error, got %v and %q", body, contentType)
+	}
+	if errors.Cause(err) != readErr {
+		t.Errorf("expected the reader's error as the cause, got: %v", errors.Cause(err))
+	}
+	// the boundary is always the same length, so the part's header is too
+	var header bytes.Buffer
+	if _, err := multipart.NewWriter(&header).CreateFormFile("ngc", "ngc"); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("couldn't write ngc field of request to Name Resolver API after %d bytes", header.Len()+len(secret))
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("expected the error to contain %q, got: %s", want, err)
+	}
+	if strings.Contains(err.Error(), secret) {
+		t.Errorf("error holds the ngc's contents: %s", err)
+	}
+}
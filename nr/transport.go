@@ -0,0 +1,135 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nr
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mitre/fusera/resilient"
+	"github.com/pkg/errors"
+)
+
+// base is the transport to the Name Resolver API and client sends every
+// request over it, retrying under the shared resilient policy. It's built
+// from the roots of SetTLSConfig and the pins of PinCertificates.
+var (
+	base   = newTransport(&tls.Config{})
+	client = &http.Client{Transport: resilient.Default.Transport(base)}
+
+	tlsBase = &tls.Config{}
+	pinned  func(rawCerts [][]byte, _ [][]*x509.Certificate) error
+)
+
+// SetTLSConfig has the Name Resolver API verified with cfg, such as to
+// trust a private CA, on top of any pins.
+func SetTLSConfig(cfg *tls.Config) {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	tlsBase = cfg
+	rebuildTransport()
+}
+
+func rebuildTransport() {
+	cfg := tlsBase.Clone()
+	cfg.VerifyPeerCertificate = pinned
+	base = newTransport(cfg)
+	client.Transport = resilient.Default.Transport(base)
+}
+
+// newTransport goes through the proxy named by HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY, as the transport awsutil reads ngc files and data over
+// does, and gives up on connecting just as soon, so a run behind a proxy
+// either reaches both or fails the same way on both.
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   15 * time.Second,
+			KeepAlive: 15 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       20 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// PinCertificates makes every connection to the Name Resolver API fail
+// unless a certificate in the chain it was verified through matches one
+// of pins, even if the chain is otherwise trusted. A connection that
+// isn't verified, as with InsecureSkipVerify, never matches. A pin is
+// either the base64 sha256 of a certificate's public key (SPKI),
+// optionally prefixed with "sha256/":
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+//
+// or the hex sha256 fingerprint of a whole certificate, colons allowed.
+// Giving no pins turns pinning off.
+func PinCertificates(pins []string) error {
+	spki := make(map[string]bool)
+	fingerprints := make(map[string]bool)
+	for _, p := range pins {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if fp := strings.ToLower(strings.Replace(p, ":", "", -1)); len(fp) == 2*sha256.Size {
+			if _, err := hex.DecodeString(fp); err == nil {
+				fingerprints[fp] = true
+				continue
+			}
+		}
+		p = strings.TrimPrefix(p, "sha256/")
+		if sum, err := base64.StdEncoding.DecodeString(p); err != nil || len(sum) != sha256.Size {
+			return errors.Errorf("certificate pin isn't a base64 sha256 of a public key or a hex sha256 fingerprint: %s", p)
+		}
+		spki[p] = true
+	}
+	pinned = nil
+	if len(spki) > 0 || len(fingerprints) > 0 {
+		pinned = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			// only certificates the chain was verified through count, or
+			// a server could present its own leaf with a pinned one
+			// tacked on after it
+			if len(verifiedChains) == 0 {
+				return errors.New("Name Resolver API's certificate chain wasn't verified, so it can't be checked against the pins")
+			}
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					fp := sha256.Sum256(cert.Raw)
+					if fingerprints[hex.EncodeToString(fp[:])] {
+						return nil
+					}
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if spki[base64.StdEncoding.EncodeToString(sum[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("Name Resolver API presented a certificate chain that doesn't match any pin")
+		}
+	}
+	rebuildTransport()
+	return nil
+}
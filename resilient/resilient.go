@@ -0,0 +1,327 @@
+// Copyright 2018 The MITRE Corporation
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resilient holds the retry and circuit breaking policy shared by
+// every request fusera makes, to the Name Resolver API and for data alike.
+// Each caller keeps its own http.Client, with its own TLS and redirect
+// settings, and routes it through Default.Transport so that all of them
+// back off, give up and report in the same way.
+package resilient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattrbianchi/twig"
+)
+
+// Policy says how hard a request is tried before giving up.
+type Policy struct {
+	// Retries is how many more times a failed attempt is made.
+	Retries int
+	// Backoff before the first retry, doubling up to MaxBackoff. The wait
+	// actually taken is picked at random from up to that, see Backoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetryAfter caps how long a server asking for a pause with
+	// Retry-After is waited on; a longer ask isn't retried at all.
+	MaxRetryAfter time.Duration
+	// BreakAfter consecutive failures against a host open its circuit,
+	// failing every request to it straight away until Cooldown has
+	// passed. Zero never opens it.
+	BreakAfter int
+	Cooldown   time.Duration
+}
+
+// DefaultPolicy is what Default starts out with.
+var DefaultPolicy = Policy{
+	Retries:       3,
+	MinBackoff:    500 * time.Millisecond,
+	MaxBackoff:    30 * time.Second,
+	MaxRetryAfter: 2 * time.Minute,
+	BreakAfter:    10,
+	Cooldown:      30 * time.Second,
+}
+
+// Attempt describes one try of a request, for an Observer.
+type Attempt struct {
+	Method string
+	Host   string
+	// Try is 1 for the first attempt.
+	Try     int
+	Status  int
+	Err     error
+	Elapsed time.Duration
+	// Wait is how long until the next try, zero when there won't be one.
+	Wait time.Duration
+}
+
+// An Observer is told about every attempt, such as to keep metrics.
+// It's called synchronously, so it shouldn't block.
+type Observer func(Attempt)
+
+// Client applies a Policy to the requests of any number of http.Clients
+// and keeps the state of each host's circuit.
+type Client struct {
+	mu       sync.Mutex
+	policy   Policy
+	observer Observer
+	// consecutive failures and when the circuit closes again, by host
+	failures map[string]int
+	openTill map[string]time.Time
+}
+
+// Default is the Client every package of fusera goes through.
+var Default = New(DefaultPolicy)
+
+// New returns a Client applying p.
+func New(p Policy) *Client {
+	return &Client{
+		policy:   p,
+		failures: make(map[string]int),
+		openTill: make(map[string]time.Time),
+	}
+}
+
+// SetPolicy replaces the policy for requests made from now on.
+func (c *Client) SetPolicy(p Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = p
+}
+
+// Policy is the policy in use.
+func (c *Client) Policy() Policy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policy
+}
+
+// SetObserver has o told about every attempt from now on, nil to stop.
+func (c *Client) SetObserver(o Observer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observer = o
+}
+
+type policyKey struct{}
+
+// WithPolicy returns a copy of ctx under which requests are tried by p
+// rather than by the policy of the Client they go through. The circuit
+// of each host is still shared.
+func WithPolicy(ctx context.Context, p Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// CircuitOpenError is returned without trying a request to a host that
+// has been failing.
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("not sending requests to %s until %s after repeated failures", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// Transport returns a RoundTripper that sends requests over base, nil
+// meaning http.DefaultTransport, retrying them under c's policy.
+func (c *Client) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{client: c, base: base}
+}
+
+type transport struct {
+	client *Client
+	base   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return t.client.do(base, req)
+}
+
+func (c *Client) do(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	p, ok := req.Context().Value(policyKey{}).(Policy)
+	if !ok {
+		p = c.Policy()
+	}
+	host := req.URL.Host
+	// a body that can't be read again can only be sent once
+	replayable := req.Body == nil || req.GetBody != nil
+	for try := 1; ; try++ {
+		if err := c.allow(host); err != nil {
+			return nil, err
+		}
+		attempt := req
+		if try > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt = req.WithContext(req.Context())
+			attempt.Body = body
+		}
+		start := time.Now()
+		resp, err := base.RoundTrip(attempt)
+		a := Attempt{Method: req.Method, Host: host, Try: try, Err: err, Elapsed: time.Since(start)}
+		if resp != nil {
+			a.Status = resp.StatusCode
+		}
+		failed := err != nil || transient(resp.StatusCode)
+		c.record(host, failed, p)
+		wait, retry := time.Duration(0), false
+		if failed && replayable && try <= p.Retries && req.Context().Err() == nil {
+			wait, retry = backoff(p, try, resp)
+		}
+		if retry {
+			a.Wait = wait
+		}
+		c.observe(a)
+		if !retry {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		twig.Debugf("%s %s failed (try %d, %s), retrying in %s", req.Method, host, try, describe(resp, err), wait)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// transient reports whether a status is worth trying again.
+func transient(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait before try+1, and false when the
+// server asked for a longer pause than the policy allows.
+func backoff(p Policy, try int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if d > p.MaxRetryAfter {
+				return 0, false
+			}
+			return d, true
+		}
+	}
+	return Backoff{Base: p.MinBackoff, Cap: p.MaxBackoff}.Next(try), true
+}
+
+// Backoff works out the waits between the retries of anything tried
+// more than once.
+type Backoff struct {
+	// Base is the longest wait before the first retry, doubled for every
+	// retry after it until it reaches Cap.
+	Base time.Duration
+	Cap  time.Duration
+}
+
+// Next is the wait before retry number attempt, counting from 1, picked at
+// random from anywhere up to Base doubled for every retry before it, or
+// Cap if that's less. Spreading the whole range keeps many workers hit by
+// the same failure from coming back in step.
+func (b Backoff) Next(attempt int) time.Duration {
+	d := b.Base
+	for i := 1; i < attempt && d < b.Cap; i++ {
+		d *= 2
+	}
+	if d > b.Cap {
+		d = b.Cap
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryAfter parses a Retry-After header, either in seconds or as a date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// allow fails when host's circuit is open. Once the cooldown has passed
+// requests go through again, and the next failure opens it right back up.
+func (c *Client) allow(host string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until, ok := c.openTill[host]; ok && time.Now().Before(until) {
+		return &CircuitOpenError{Host: host, Until: until}
+	}
+	return nil
+}
+
+func (c *Client) record(host string, failed bool, p Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		delete(c.failures, host)
+		delete(c.openTill, host)
+		return
+	}
+	c.failures[host]++
+	if p.BreakAfter > 0 && c.failures[host] >= p.BreakAfter {
+		if _, open := c.openTill[host]; !open || time.Now().After(c.openTill[host]) {
+			twig.Debugf("%d failures in a row from %s, holding off for %s", c.failures[host], host, p.Cooldown)
+		}
+		c.openTill[host] = time.Now().Add(p.Cooldown)
+	}
+}
+
+func (c *Client) observe(a Attempt) {
+	c.mu.Lock()
+	o := c.observer
+	c.mu.Unlock()
+	if o != nil {
+		o(a)
+	}
+}
+
+func describe(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}